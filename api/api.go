@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -10,6 +11,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/gorilla/mux"
 )
@@ -17,10 +20,44 @@ import (
 type PermissionLevel int
 
 type File struct {
-	Id         string `json:"id"`
-	Name       string `json:"name"`
-	UploadedAt string `json:"uploadedAt"`
-	Creator    string `json:"creator"`
+	Id            string   `json:"id"`
+	Name          string   `json:"name"`
+	UploadedAt    string   `json:"uploadedAt"`
+	Creator       string   `json:"creator"`
+	MimeType      string   `json:"mimeType"`
+	ExpiresAt     *string  `json:"expiresAt"`
+	MaxDownloads  *int     `json:"maxDownloads"`
+	DownloadCount int      `json:"downloadCount"`
+	HasPassword   bool     `json:"hasPassword"`
+	Private       bool     `json:"private"`
+	Size          int64    `json:"size"`
+	Thumbnail     *string  `json:"thumbnail"`
+	Description   string   `json:"description"`
+	Tags          []string `json:"tags"`
+	Version       int      `json:"version"`
+}
+
+// fileColumns are the columns of a file read by scanFile, in order
+const fileColumns = `files.id, files.file_name, files.uploaded_at, files.creator, files.mime_type, files.expires_at,
+	files.max_downloads, files.download_count, files.password_hash IS NOT NULL, files.private, files.size, files.description,
+	(SELECT group_concat(tag, ',') FROM (SELECT tag FROM file_tags WHERE file_id = files.id ORDER BY tag)), files.version`
+
+// UpdateFileRequestBody changes only the fields that are set
+type UpdateFileRequestBody struct {
+	Name        *string   `json:"name,omitempty"`
+	Tags        *[]string `json:"tags,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	Private     *bool     `json:"private,omitempty"`
+}
+
+type UploadOptions struct {
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+	MaxDownloads *int       `json:"maxDownloads,omitempty"`
+	PasswordHash string     `json:"passwordHash,omitempty"`
+	Private      bool       `json:"private,omitempty"`
+	Collection   string     `json:"collection,omitempty"`
+	Tags         []string   `json:"tags,omitempty"`
+	Description  string     `json:"description,omitempty"`
 }
 
 const (
@@ -30,45 +67,79 @@ const (
 	Administrator
 )
 
-func validatePerms(requiredPerms PermissionLevel, next http.HandlerFunc) http.HandlerFunc {
+// validatePerms only calls next for requests whose API key belongs to a user with at least requiredPerms and
+// a token with every scope in requiredScopes. ScopeUpload only allows creating new files, so changing the name,
+// content or version of an existing file needs ScopeModify and deleting one needs ScopeDelete
+func validatePerms(requiredPerms PermissionLevel, requiredScopes Scope, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		apiKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
 
-		var perms PermissionLevel
-		var username string
-		if err := db.QueryRow("SELECT permissions, username FROM users WHERE api_key = ?", apiKey).Scan(&perms, &username); err != nil {
+		token, user, expired, err := findToken(apiKey)
+		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
+				auditDeniedRequest(r, "", "Invalid API key")
+				metrics.authFailure("invalid_key")
 				respondJSON(w, http.StatusUnauthorized, map[string]any{"message": "Invalid API key"})
 				return
 			}
 			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-			logger.Error("Error querying permissions from API key:", err.Error())
+			logger.Request(r).Error("Error querying permissions from API key", "error", err)
 			return
 		}
 
-		if perms < requiredPerms {
+		if expired {
+			auditDeniedRequest(r, user.Username, "API key has expired")
+			metrics.authFailure("expired_key")
+			respondJSON(w, http.StatusUnauthorized, map[string]any{"message": "API key has expired"})
+			return
+		}
+
+		if user.Disabled {
+			auditDeniedRequest(r, user.Username, "User is disabled")
+			metrics.authFailure("disabled_user")
+			respondJSON(w, http.StatusUnauthorized, map[string]any{"message": "User is disabled"})
+			return
+		}
+
+		if user.Permissions < requiredPerms || token.Scopes&requiredScopes != requiredScopes {
+			auditDeniedRequest(r, user.Username, "Insufficient permissions")
+			metrics.authFailure("insufficient_permissions")
 			respondJSON(w, http.StatusUnauthorized, map[string]any{"message": "Insufficient permissions"})
 			return
 		}
 
-		r.Header.Set("username", username)
-		r.Header.Set("permissions", strconv.Itoa(int(perms)))
+		if _, err = db.Exec("UPDATE tokens SET last_used_at = datetime('now') WHERE id = ?", token.Id); err != nil {
+			logger.Request(r).Warn("Error updating token last used time", "error", err)
+		}
+
+		r.Header.Set("username", user.Username)
+		r.Header.Set("permissions", strconv.Itoa(int(user.Permissions)))
+		r.Header.Set("tokenId", strconv.FormatInt(token.Id, 10))
+		r.Header.Set("tokenName", token.Name)
+		r.Header.Set("scopes", strconv.Itoa(int(token.Scopes)))
 
 		next.ServeHTTP(w, r)
 	}
 }
 
-func newFileId() (string, error) {
+// randomShareId generates the short IDs used in public links to files and collections
+func randomShareId() string {
 	charset := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
 
 	result := make([]byte, 8)
 	for i := range result {
 		result[i] = charset[rand.Intn(len(charset))]
 	}
-	resultStr := string(result)
+	return string(result)
+}
+
+func newFileId() (string, error) {
+	resultStr := randomShareId()
 
 	var count int
-	if err := db.QueryRow("SELECT COUNT(*) FROM files WHERE id = ?", resultStr).Scan(&count); err != nil {
+	if err := db.QueryRow(
+		"SELECT (SELECT COUNT(*) FROM files WHERE id = ?) + (SELECT COUNT(*) FROM expired_files WHERE id = ?)", resultStr, resultStr,
+	).Scan(&count); err != nil {
 		return "", err
 	}
 
@@ -78,6 +149,336 @@ func newFileId() (string, error) {
 	return resultStr, nil
 }
 
+const maxFileNameLength = 255
+
+func validateFileName(name string) error {
+	if name == "" || len(name) > maxFileNameLength {
+		return fmt.Errorf("The file name must be between 1 and %d bytes", maxFileNameLength)
+	}
+	if strings.ContainsAny(name, "/\\") || strings.ContainsFunc(name, unicode.IsControl) {
+		return errors.New("The file name can't contain slashes or control characters")
+	}
+	return nil
+}
+
+func blobPath(fileId string) string {
+	return fmt.Sprintf("db/%s.dat", fileId)
+}
+
+// scanFile reads a file selected with fileColumns
+func scanFile(row interface{ Scan(...any) error }) (File, error) {
+	var file File
+	var tags *string
+	err := row.Scan(
+		&file.Id, &file.Name, &file.UploadedAt, &file.Creator, &file.MimeType, &file.ExpiresAt, &file.MaxDownloads, &file.DownloadCount,
+		&file.HasPassword, &file.Private, &file.Size, &file.Description, &tags, &file.Version,
+	)
+	if err != nil {
+		return file, err
+	}
+
+	file.Tags = []string{}
+	if tags != nil {
+		file.Tags = strings.Split(*tags, ",")
+	}
+	if hasThumbnail(file.MimeType, file.MaxDownloads) {
+		thumbnail := thumbnailURL(file.Id, file.Version)
+		file.Thumbnail = &thumbnail
+	}
+	return file, nil
+}
+
+// parseUploadOptions reads the optional settings shared by /upload form fields and tus upload metadata
+func parseUploadOptions(get func(string) string) (UploadOptions, error) {
+	var options UploadOptions
+
+	expiresIn, expiresAt := get("expires_in"), get("expires_at")
+	if expiresIn != "" && expiresAt != "" {
+		return options, errors.New("Only one of expires_in and expires_at can be set")
+	}
+	if expiresIn != "" {
+		duration, err := parseDuration(expiresIn)
+		if err != nil || duration <= 0 {
+			return options, errors.New("Invalid expires_in duration")
+		}
+		expires := time.Now().Add(duration)
+		options.ExpiresAt = &expires
+	}
+	if expiresAt != "" {
+		expires, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return options, errors.New("Invalid expires_at time - use RFC 3339, e.g. 2006-01-02T15:04:05Z")
+		}
+		if !expires.After(time.Now()) {
+			return options, errors.New("expires_at must be in the future")
+		}
+		options.ExpiresAt = &expires
+	}
+
+	maxDownloads, burnAfterReading := get("max_downloads"), get("burn_after_reading")
+	if maxDownloads != "" {
+		n, err := strconv.Atoi(maxDownloads)
+		if err != nil || n <= 0 {
+			return options, errors.New("max_downloads must be a positive whole number")
+		}
+		options.MaxDownloads = &n
+	}
+	if burnAfterReading != "" {
+		burn, err := strconv.ParseBool(burnAfterReading)
+		if err != nil {
+			return options, errors.New("Invalid burn_after_reading value - use true or false")
+		}
+		if burn {
+			if options.MaxDownloads != nil && *options.MaxDownloads != 1 {
+				return options, errors.New("burn_after_reading can't be combined with max_downloads")
+			}
+			n := 1
+			options.MaxDownloads = &n
+		}
+	}
+
+	if private := get("private"); private != "" {
+		var err error
+		if options.Private, err = strconv.ParseBool(private); err != nil {
+			return options, errors.New("Invalid private value - use true or false")
+		}
+	}
+
+	options.Collection = get("collection")
+
+	if tags := get("tags"); tags != "" {
+		var err error
+		if options.Tags, err = parseTags(strings.Split(tags, ",")); err != nil {
+			return options, err
+		}
+	}
+	options.Description = strings.TrimSpace(get("description"))
+	if err := validateDescription(options.Description); err != nil {
+		return options, err
+	}
+
+	// Only the hash is kept, including in the options saved for unfinished tus uploads
+	if password := get("password"); password != "" {
+		passwordHash, err := hashFilePassword(password)
+		if err != nil {
+			return options, err
+		}
+		options.PasswordHash = passwordHash
+	}
+
+	return options, nil
+}
+
+// storeFile moves a fully received upload from tempPath to a new file ID and records it in the database,
+// deleting the data again if either step fails or the user doesn't have room for it
+func storeFile(tempPath string, fileName string, username string, options UploadOptions) (string, error) {
+	fileId, err := newFileId()
+	if err != nil {
+		if removeErr := os.Remove(tempPath); removeErr != nil {
+			logger.Error("Error deleting file", "path", tempPath, "error", removeErr)
+		}
+		return "", err
+	}
+
+	info, err := os.Stat(tempPath)
+	if err != nil {
+		if removeErr := os.Remove(tempPath); removeErr != nil {
+			logger.Error("Error deleting file", "path", tempPath, "error", removeErr)
+		}
+		return "", err
+	}
+
+	mimeType, err := detectMimeType(tempPath, fileName)
+	if err != nil {
+		logger.Warn("Error detecting type of file", "fileId", fileId, "error", err)
+		mimeType = defaultMimeType
+	}
+
+	filePath := blobPath(fileId)
+	if err = os.Rename(tempPath, filePath); err != nil {
+		if removeErr := os.Remove(tempPath); removeErr != nil {
+			logger.Error("Error deleting file", "path", tempPath, "error", removeErr)
+		}
+		return "", err
+	}
+
+	var expiresAt *string
+	if options.ExpiresAt != nil {
+		formatted := options.ExpiresAt.UTC().Format(sqliteTimeFormat)
+		expiresAt = &formatted
+	}
+
+	var passwordHash *string
+	if options.PasswordHash != "" {
+		passwordHash = &options.PasswordHash
+	}
+
+	// The quota is checked in the same statement as the insert, so concurrent uploads can't both squeeze in
+	res, err := db.Exec(
+		`INSERT INTO files (id, file_name, uploaded_at, creator, mime_type, expires_at, max_downloads, password_hash, private, size, description)
+		SELECT ?, ?, datetime('now'), ?, ?, ?, ?, ?, ?, ?, ? WHERE NOT `+quotaCondition,
+		fileId, fileName, username, mimeType, expiresAt, options.MaxDownloads, passwordHash, options.Private, info.Size(), options.Description,
+		username, info.Size(),
+	)
+	if err == nil {
+		if affected, affectedErr := res.RowsAffected(); affectedErr != nil {
+			err = affectedErr
+		} else if affected == 0 {
+			err = errQuotaExceeded
+		}
+	}
+	if err != nil {
+		if removeErr := os.Remove(filePath); removeErr != nil {
+			logger.Error("Error deleting file", "path", filePath, "error", removeErr)
+		}
+		return "", err
+	}
+
+	if len(options.Tags) > 0 {
+		if err = setFileTags(fileId, options.Tags); err != nil {
+			logger.Error("Error tagging file", "fileId", fileId, "error", err)
+		}
+	}
+	if options.Collection != "" {
+		if err = addToCollection(options.Collection, fileId); err != nil {
+			logger.Error("Error adding file to collection", "fileId", fileId, "error", err)
+		}
+	}
+
+	runInBackground(func() {
+		if _, err := fileChecksum(fileId); err != nil {
+			logger.Warn("Error calculating checksum of file", "fileId", fileId, "error", err)
+		}
+	})
+
+	if hasThumbnail(mimeType, options.MaxDownloads) {
+		runInBackground(func() {
+			if err := generateThumbnails(fileId, mimeType, thumbnailSizes); err != nil {
+				logger.Warn("Error making thumbnails for file", "fileId", fileId, "error", err)
+			}
+		})
+	}
+
+	return fileId, nil
+}
+
+// respondFileNotFound responds with 410 Gone for files that have expired or used up their downloads
+// and 404 Not Found otherwise
+func respondFileNotFound(w http.ResponseWriter, fileId string) {
+	var reason string
+	if err := db.QueryRow("SELECT reason FROM expired_files WHERE id = ?", fileId).Scan(&reason); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondJSON(w, http.StatusNotFound, map[string]any{"message": "File not found"})
+			return
+		}
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Error("Error querying expired file from ID", "error", err)
+		return
+	}
+
+	if reason == retiredDownloadLimit {
+		respondJSON(w, http.StatusGone, map[string]any{"message": "File has reached its download limit"})
+		return
+	}
+	respondJSON(w, http.StatusGone, map[string]any{"message": "File has expired"})
+}
+
+// storedFile holds the details needed to serve a file
+type storedFile struct {
+	name         string
+	mimeType     string
+	creator      string
+	maxDownloads *int
+	passwordHash *string
+	private      bool
+	version      int
+}
+
+// authorizeDownload looks up a file and checks the request is allowed to download it,
+// responding with the reason if not
+func authorizeDownload(w http.ResponseWriter, r *http.Request, fileId string) (storedFile, bool) {
+	var stored storedFile
+	var expired bool
+	if err := db.QueryRow(
+		`SELECT file_name, mime_type, creator, expires_at IS NOT NULL AND expires_at <= datetime('now'), max_downloads, password_hash, private,
+		version FROM files WHERE id = ?`, fileId,
+	).Scan(&stored.name, &stored.mimeType, &stored.creator, &expired, &stored.maxDownloads, &stored.passwordHash, &stored.private,
+		&stored.version); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondFileNotFound(w, fileId)
+			return stored, false
+		}
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Request(r).Error("Error querying file from ID", "error", err)
+		return stored, false
+	}
+
+	if expired {
+		respondJSON(w, http.StatusGone, map[string]any{"message": "File has expired"})
+		return stored, false
+	}
+
+	if stored.private && !checkPrivateAccess(w, r, fileId, stored.creator) {
+		return stored, false
+	}
+	if stored.passwordHash != nil && !checkFileAccess(w, r, fileId, *stored.passwordHash) {
+		return stored, false
+	}
+
+	return stored, true
+}
+
+// authorizeFileOwner checks a file exists and was uploaded by the user making the request,
+// unless they can manage all files, responding with the reason if not
+func authorizeFileOwner(w http.ResponseWriter, r *http.Request, fileId string) bool {
+	perms, err := getPermissions(r)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Request(r).Warn("Error parsing permissions header", "error", err)
+		return false
+	}
+
+	var creator string
+	if err = db.QueryRow("SELECT creator FROM files WHERE id = ?", fileId).Scan(&creator); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondJSON(w, http.StatusNotFound, map[string]any{"message": "File not found"})
+			return false
+		}
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Request(r).Error("Error querying file creator from ID", "error", err)
+		return false
+	}
+
+	if perms < ReadWriteAll && creator != r.Header.Get("username") {
+		auditDeniedRequest(r, r.Header.Get("username"), "Not the file's owner")
+		respondJSON(w, http.StatusUnauthorized, map[string]any{"message": "Insufficient permissions"})
+		return false
+	}
+	return true
+}
+
+// removeFile deletes a file's database row, tags, data, old versions and thumbnails, and takes it out of any collections
+func removeFile(fileId string) error {
+	if _, err := db.Exec("DELETE FROM files WHERE id = ?", fileId); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM collection_files WHERE file_id = ?", fileId); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM file_tags WHERE file_id = ?", fileId); err != nil {
+		return err
+	}
+
+	if err := os.Remove(blobPath(fileId)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := removeVersions(fileId); err != nil {
+		return err
+	}
+
+	return removeThumbnails(fileId)
+}
+
 func getPermissions(r *http.Request) (PermissionLevel, error) {
 	perms, err := strconv.Atoi(r.Header.Get("permissions"))
 	if err != nil {
@@ -87,120 +488,173 @@ func getPermissions(r *http.Request) (PermissionLevel, error) {
 }
 
 func handleApi(r *mux.Router) {
-	r.HandleFunc("/upload", validatePerms(ReadWriteSelf, func(w http.ResponseWriter, r *http.Request) {
-		r.Body = http.MaxBytesReader(w, r.Body, 500*1024*1024) // 500MB limit
+	r.HandleFunc("/upload", validatePerms(ReadWriteSelf, ScopeUpload, func(w http.ResponseWriter, r *http.Request) {
+		maxUploadSize, err := requestMaxUploadSize(r)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying upload limit", "error", err)
+			return
+		}
+		if r.ContentLength > maxUploadSize+multipartOverhead {
+			respondTooLarge(w, maxUploadSize)
+			return
+		}
 
-		if err := r.ParseMultipartForm(10 << 20); err != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+multipartOverhead)
+
+		if err = r.ParseMultipartForm(10 << 20); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				respondTooLarge(w, maxUploadSize)
+				return
+			}
 			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid multipart form data"})
-			logger.Warn("Upload failed - malformed form data:", err.Error())
+			logger.Request(r).Warn("Upload failed - malformed form data", "error", err)
 			return
 		}
 
 		file, handler, err := r.FormFile("file")
 		if err != nil {
 			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Missing file in request"})
-			logger.Warn("Upload failed - missing file field:", err.Error())
+			logger.Request(r).Warn("Upload failed - missing file field", "error", err)
 			return
 		}
 		defer func(file multipart.File) {
 			if err = file.Close(); err != nil {
-				logger.Error("Error closing uploaded file:", err.Error())
+				logger.Request(r).Error("Error closing uploaded file", "error", err)
 			}
 		}(file)
 
-		fileId, err := newFileId()
-		if err != nil {
-			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-			logger.Error("Error generating file ID:", err.Error())
+		if handler.Size > maxUploadSize {
+			respondTooLarge(w, maxUploadSize)
+			return
+		}
+
+		if err := validateFileName(handler.Filename); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": err.Error()})
+			return
 		}
 
 		username := r.Header.Get("username")
-		_, err = db.Exec("INSERT INTO files (id, file_name, uploaded_at, creator) VALUES (?, ?, datetime('now'), ?)", fileId, handler.Filename, username)
+
+		options, err := parseUploadOptions(r.FormValue)
 		if err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": err.Error()})
+			return
+		}
+
+		if options.Collection != "" && !authorizeCollection(w, r, options.Collection) {
+			return
+		}
+
+		// Fail early for users that are already at their quota, the file's size is checked once it's received
+		if ok, err := checkQuota(username, 0); err != nil {
 			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-			logger.Error("Error inserting file into database:", err.Error())
+			logger.Request(r).Error("Error checking storage quota", "error", err)
+			return
+		} else if !ok {
+			respondQuotaExceeded(w, username, true)
 			return
 		}
 
-		filePath := fmt.Sprintf("db/%s.dat", fileId)
-		outFile, err := os.Create(filePath)
+		tempFile, err := os.CreateTemp(partialDir, "upload-*.part")
 		if err != nil {
 			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-			logger.Error(fmt.Sprintf("Error creating file %s:", filePath), err.Error())
+			logger.Request(r).Error("Error creating temporary file", "error", err)
 			return
 		}
-		defer func(file *os.File) {
-			if err = file.Close(); err != nil {
-				logger.Error(fmt.Sprintf("Error closing file %s:", filePath), err.Error())
-			}
-		}(outFile)
+		tempPath := tempFile.Name()
 
-		if _, err = file.Seek(0, 0); err != nil {
+		_, err = tempFile.ReadFrom(file)
+		if closeErr := tempFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
 			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-			logger.Error("Error resetting file stream:", err.Error())
+			logger.Request(r).Error("Error writing to file", "path", tempPath, "error", err)
+			if err = os.Remove(tempPath); err != nil {
+				logger.Request(r).Error("Error deleting file", "path", tempPath, "error", err)
+			}
 			return
 		}
 
-		if _, err = outFile.ReadFrom(file); err != nil {
+		fileId, err := storeFile(tempPath, handler.Filename, username, options)
+		if errors.Is(err, errQuotaExceeded) {
+			respondQuotaExceeded(w, username, true)
+			return
+		}
+		if err != nil {
 			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-			logger.Error("Error writing to file:", err.Error())
+			logger.Request(r).Error("Error storing uploaded file", "error", err)
 			return
 		}
 
-		logger.Info(fmt.Sprintf("File %s uploaded by %s", fileId, username))
+		logger.Request(r).Info("File uploaded", "fileId", fileId)
+		audit(r, "file.upload", fileId, handler.Filename)
 		respondJSON(w, http.StatusCreated, map[string]any{
 			"message": "File uploaded successfully",
 			"id":      fmt.Sprint(fileId),
 		})
 	})).Methods("POST")
 
-	r.HandleFunc("/list", validatePerms(ReadWriteSelf, func(w http.ResponseWriter, r *http.Request) {
+	r.HandleFunc("/list", validatePerms(ReadWriteSelf, ScopeList, func(w http.ResponseWriter, r *http.Request) {
 		perms, err := getPermissions(r)
 		if err != nil {
 			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-			logger.Warn("Error parsing permissions header:", err.Error())
+			logger.Request(r).Warn("Error parsing permissions header", "error", err)
 			return
 		}
 
-		var rows *sql.Rows
-
+		list, err := parseListQuery(r.URL.Query())
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": err.Error()})
+			return
+		}
 		if perms < ReadWriteAll {
-			username := r.Header.Get("username")
-			rows, err = db.Query("SELECT id, file_name, uploaded_at, creator FROM files WHERE creator = ?", username)
-			if err != nil {
-				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-				logger.Warn("Error querying files from creator:", err.Error())
-				return
-			}
-		} else {
-			rows, err = db.Query("SELECT id, file_name, uploaded_at, creator FROM files")
-			if err != nil {
-				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-				logger.Warn("Error querying all files:", err.Error())
-				return
-			}
+			list.conditions = append(list.conditions, "files.creator = ?")
+			list.args = append(list.args, r.Header.Get("username"))
+		}
+
+		query, args, err := list.sql()
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": err.Error()})
+			return
+		}
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Warn("Error querying files", "error", err)
+			return
 		}
 		defer func(rows *sql.Rows) {
 			if err = rows.Close(); err != nil {
-				logger.Error("Error closing queried rows:", err.Error())
+				logger.Request(r).Error("Error closing queried rows", "error", err)
 			}
 		}(rows)
 
 		var files []File
 		for rows.Next() {
-			var file File
-			err = rows.Scan(&file.Id, &file.Name, &file.UploadedAt, &file.Creator)
+			file, err := scanFile(rows)
 			if err != nil {
 				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-				logger.Warn("Error reading queried row:", err.Error())
+				logger.Request(r).Warn("Error reading queried row", "error", err)
 				return
 			}
 			files = append(files, file)
 		}
 
+		var nextCursor *string
+		if len(files) > list.limit {
+			files = files[:list.limit]
+			cursor := list.nextCursor(files[len(files)-1])
+			nextCursor = &cursor
+		}
+
 		respondJSON(w, http.StatusOK, map[string]any{
-			"message": "Files fetched successfully",
-			"files":   files,
+			"message":    "Files fetched successfully",
+			"files":      files,
+			"nextCursor": nextCursor,
 		})
 	})).Methods("GET")
 
@@ -209,84 +663,166 @@ func handleApi(r *mux.Router) {
 
 		fileId := mux.Vars(r)["fileId"]
 
-		var fileName string
-		if err = db.QueryRow("SELECT file_name FROM files WHERE id = ?", fileId).Scan(&fileName); err != nil {
+		stored, ok := authorizeDownload(w, r, fileId)
+		if !ok {
+			return
+		}
+
+		if version := r.URL.Query().Get("v"); version != "" {
+			serveVersion(w, r, fileId, stored, version)
+			return
+		}
+
+		filePath := blobPath(fileId)
+		file, err := os.Open(filePath)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error opening file", "path", filePath, "error", err)
+			return
+		}
+		defer func(file *os.File) {
+			if err = file.Close(); err != nil {
+				logger.Request(r).Error("Error closing file", "path", filePath, "error", err)
+			}
+		}(file)
+
+		if stored.maxDownloads != nil {
+			serveLimitedFile(w, r, fileId, stored.name, stored.mimeType, file)
+			return
+		}
+		respondFile(w, r, stored.name, stored.mimeType, file)
+	}).Methods("GET", "HEAD")
+
+	// Submissions from the password page of a protected file
+	r.HandleFunc("/{fileId}", func(w http.ResponseWriter, r *http.Request) {
+		fileId := mux.Vars(r)["fileId"]
+
+		var expired bool
+		var passwordHash *string
+		if err := db.QueryRow(
+			"SELECT expires_at IS NOT NULL AND expires_at <= datetime('now'), password_hash FROM files WHERE id = ?", fileId,
+		).Scan(&expired, &passwordHash); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				respondJSON(w, http.StatusNotFound, map[string]any{"message": "File not found"})
+				respondFileNotFound(w, fileId)
 				return
 			}
 			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-			logger.Error("Error querying file from ID:", err.Error())
+			logger.Request(r).Error("Error querying file from ID", "error", err)
 			return
 		}
 
-		var fileData []byte
-		filePath := fmt.Sprintf("db/%s.dat", fileId)
-		if fileData, err = os.ReadFile(filePath); err != nil {
-			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-			logger.Error(fmt.Sprintf("Error reading file %s:", filePath), err.Error())
+		if expired {
+			respondJSON(w, http.StatusGone, map[string]any{"message": "File has expired"})
+			return
+		}
+		if passwordHash == nil {
+			http.Redirect(w, r, "/"+fileId, http.StatusSeeOther)
 			return
 		}
 
-		respondFile(w, http.StatusOK, fileName, fileData)
-	}).Methods("GET")
-
-	r.HandleFunc("/{fileId}", validatePerms(ReadWriteSelf, func(w http.ResponseWriter, r *http.Request) {
-		var err error
+		handlePasswordForm(w, r, fileId, *passwordHash)
+	}).Methods("POST")
 
+	r.HandleFunc("/{fileId}", validatePerms(ReadWriteSelf, ScopeModify, func(w http.ResponseWriter, r *http.Request) {
 		fileId := mux.Vars(r)["fileId"]
-		username := r.Header.Get("username")
 
-		perms, err := getPermissions(r)
-		if err != nil {
-			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-			logger.Warn("Error parsing permissions header:", err.Error())
+		var body UpdateFileRequestBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid JSON body"})
 			return
 		}
 
-		if perms < ReadWriteAll {
-			var fileUser string
-			if err = db.QueryRow("SELECT creator FROM files WHERE id = ?", fileId).Scan(&fileUser); err != nil {
-				if errors.Is(err, sql.ErrNoRows) {
-					respondJSON(w, http.StatusNotFound, map[string]any{"message": "File not found"})
-					return
-				}
+		if !authorizeFileOwner(w, r, fileId) {
+			return
+		}
+
+		var sets []string
+		var args []any
+		if body.Name != nil {
+			name := strings.TrimSpace(*body.Name)
+			if err := validateFileName(name); err != nil {
+				respondJSON(w, http.StatusBadRequest, map[string]any{"message": err.Error()})
+				return
+			}
+
+			// The type can depend on the extension, so it's detected again for the new name
+			mimeType, err := detectMimeType(blobPath(fileId), name)
+			if err != nil {
 				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-				logger.Error("Error querying file creator from ID:", err.Error())
+				logger.Request(r).Error("Error detecting type of file", "error", err)
 				return
 			}
+			sets = append(sets, "file_name = ?", "mime_type = ?")
+			args = append(args, name, mimeType)
+		}
+		if body.Description != nil {
+			description := strings.TrimSpace(*body.Description)
+			if err := validateDescription(description); err != nil {
+				respondJSON(w, http.StatusBadRequest, map[string]any{"message": err.Error()})
+				return
+			}
+			sets = append(sets, "description = ?")
+			args = append(args, description)
+		}
+		if body.Private != nil {
+			sets = append(sets, "private = ?")
+			args = append(args, *body.Private)
+		}
 
-			if username != fileUser {
-				respondJSON(w, http.StatusUnauthorized, map[string]any{"message": "Insufficient permissions"})
+		var tags []string
+		if body.Tags != nil {
+			var err error
+			if tags, err = parseTags(*body.Tags); err != nil {
+				respondJSON(w, http.StatusBadRequest, map[string]any{"message": err.Error()})
 				return
 			}
 		}
 
-		var count int
-		if err = db.QueryRow("SELECT COUNT(*) FROM files WHERE id = ?", fileId).Scan(&count); err != nil {
-			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-			logger.Error("Error counting files with ID:", err.Error())
-			return
+		if len(sets) > 0 {
+			if _, err := db.Exec("UPDATE files SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, fileId)...); err != nil {
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Error("Error updating file", "error", err)
+				return
+			}
 		}
-		if count == 0 {
-			respondJSON(w, http.StatusNotFound, map[string]any{"message": "File not found"})
-			return
+		if body.Tags != nil {
+			if err := setFileTags(fileId, tags); err != nil {
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Error("Error updating file tags", "error", err)
+				return
+			}
 		}
 
-		if err = db.QueryRow("DELETE FROM files WHERE id = ?", fileId).Scan(); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		file, err := scanFile(db.QueryRow("SELECT "+fileColumns+" FROM files WHERE id = ?", fileId))
+		if err != nil {
 			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-			logger.Error("Error deleting file from ID:", err.Error())
+			logger.Request(r).Error("Error querying file from ID", "error", err)
+			return
+		}
+
+		logger.Request(r).Info("File updated")
+		audit(r, "file.update", fileId, auditDetail(body))
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message": "File updated successfully",
+			"file":    file,
+		})
+	})).Methods("PATCH")
+
+	r.HandleFunc("/{fileId}", validatePerms(ReadWriteSelf, ScopeDelete, func(w http.ResponseWriter, r *http.Request) {
+		fileId := mux.Vars(r)["fileId"]
+
+		if !authorizeFileOwner(w, r, fileId) {
 			return
 		}
 
-		filePath := fmt.Sprintf("db/%s.dat", fileId)
-		if err = os.Remove(filePath); err != nil {
+		if err := removeFile(fileId); err != nil {
 			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
-			logger.Error(fmt.Sprintf("Error deleting file %s:", filePath), err.Error())
+			logger.Request(r).Error("Error deleting file", "error", err)
 			return
 		}
 
-		logger.Info(fmt.Sprintf("File %s deleted by %s", fileId, username))
+		logger.Request(r).Info("File deleted")
+		audit(r, "file.delete", fileId, "")
 		respondJSON(w, http.StatusOK, map[string]any{"message": "File deleted successfully"})
 	})).Methods("DELETE")
 }
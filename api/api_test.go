@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidatePerms(t *testing.T) {
+	setupTestDB(t)
+
+	uploadKey := addTestUser(t, "uploader", ReadWriteAll, ScopeUpload)
+	modifyKey := addTestUser(t, "editor", ReadWriteSelf, ScopeModify|ScopeList)
+	adminScopeKey := addTestUser(t, "scoped", ReadWriteSelf, AllScopes)
+	disabledKey := addTestUser(t, "disabled", ReadWriteAll, AllScopes)
+	if _, err := db.Exec("UPDATE users SET disabled = 1 WHERE username = 'disabled'"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		perms  PermissionLevel
+		scopes Scope
+		apiKey string
+		want   int
+	}{
+		{"upload token can upload", ReadWriteSelf, ScopeUpload, uploadKey, http.StatusOK},
+		{"upload token can't modify", ReadWriteSelf, ScopeModify, uploadKey, http.StatusUnauthorized},
+		{"upload token can't delete", ReadWriteSelf, ScopeDelete, uploadKey, http.StatusUnauthorized},
+		{"modify token can modify", ReadWriteSelf, ScopeModify, modifyKey, http.StatusOK},
+		{"modify token can't upload", ReadWriteSelf, ScopeUpload, modifyKey, http.StatusUnauthorized},
+		{"every scope is needed", ReadWriteSelf, ScopeModify | ScopeList, modifyKey, http.StatusOK},
+		{"missing one of the scopes", ReadWriteSelf, ScopeModify | ScopeDelete, modifyKey, http.StatusUnauthorized},
+		{"no scopes needed", ReadWriteSelf, NoScopes, uploadKey, http.StatusOK},
+		{"scopes don't raise permissions", Administrator, ScopeAdmin, adminScopeKey, http.StatusUnauthorized},
+		{"disabled user", ReadWriteSelf, NoScopes, disabledKey, http.StatusUnauthorized},
+		{"unknown key", NoPerms, NoScopes, "not a key", http.StatusUnauthorized},
+		{"master key", Administrator, AllScopes, testMasterKey, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := validatePerms(test.perms, test.scopes, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			req := httptest.NewRequest("GET", "/test", nil)
+			req.Header.Set("Authorization", "Bearer "+test.apiKey)
+			res := httptest.NewRecorder()
+			handler(res, req)
+
+			if res.Code != test.want {
+				t.Errorf("status = %d, want %d", res.Code, test.want)
+			}
+		})
+	}
+}
+
+func TestValidatePermsIgnoresClientHeaders(t *testing.T) {
+	setupTestDB(t)
+	apiKey := addTestUser(t, "alice", ReadWriteSelf, ScopeUpload)
+
+	var username, scopes string
+	handler := validatePerms(ReadWriteSelf, ScopeUpload, func(w http.ResponseWriter, r *http.Request) {
+		username, scopes = r.Header.Get("username"), r.Header.Get("scopes")
+	})
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	req.Header.Set("username", masterUsername)
+	req.Header.Set("scopes", "63")
+	handler(httptest.NewRecorder(), req)
+
+	if username != "alice" || scopes != "1" {
+		t.Errorf("handler saw username %q and scopes %q, want alice and 1", username, scopes)
+	}
+}
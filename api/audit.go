@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Changes to files, collections, tokens and users are recorded in audit_events along with failed authentication, so
+// there's a lasting record of who did what. Triggers stop events from being changed or deleted once written
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+const (
+	auditSuccess = "success"
+	auditDenied  = "denied"
+)
+
+type AuditEvent struct {
+	Id        int64   `json:"id"`
+	CreatedAt string  `json:"createdAt"`
+	Actor     *string `json:"actor"`
+	Action    string  `json:"action"`
+	Target    *string `json:"target"`
+	IP        *string `json:"ip"`
+	UserAgent *string `json:"userAgent"`
+	Result    string  `json:"result"`
+	Detail    *string `json:"detail"`
+}
+
+func initAuditLog() error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS audit_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			created_at TEXT NOT NULL DEFAULT (datetime('now')),
+			actor TEXT,
+			action TEXT NOT NULL,
+			target TEXT,
+			ip TEXT,
+			user_agent TEXT,
+			result TEXT NOT NULL,
+			detail TEXT
+		);
+		CREATE INDEX IF NOT EXISTS audit_events_actor ON audit_events (actor);
+		CREATE INDEX IF NOT EXISTS audit_events_action ON audit_events (action);
+		CREATE INDEX IF NOT EXISTS audit_events_target ON audit_events (target);
+		CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events BEGIN
+			SELECT RAISE(ABORT, 'audit events are append-only');
+		END;
+		CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events BEGIN
+			SELECT RAISE(ABORT, 'audit events are append-only');
+		END;
+	`)
+	return err
+}
+
+// nullIfEmpty stores empty strings as NULL
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// recordAuditEvent writes an event to the audit log. The request is nil for actions the server takes by itself, like
+// deleting expired files, which have no actor either. Failing to record an event is logged rather than failing the
+// action, which has already happened by then
+func recordAuditEvent(r *http.Request, actor string, action string, target string, result string, detail string) {
+	var ip, userAgent string
+	if r != nil {
+		ip, userAgent = clientIP(r), r.UserAgent()
+	}
+
+	if _, err := db.Exec(
+		"INSERT INTO audit_events (actor, action, target, ip, user_agent, result, detail) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		nullIfEmpty(actor), action, nullIfEmpty(target), nullIfEmpty(ip), nullIfEmpty(userAgent), result, nullIfEmpty(detail),
+	); err != nil {
+		logger.Request(r).Error("Error recording audit event", "action", action, "error", err)
+	}
+}
+
+// audit records a successful action by the user authenticated by validatePerms
+func audit(r *http.Request, action string, target string, detail string) {
+	recordAuditEvent(r, r.Header.Get("username"), action, target, auditSuccess, detail)
+}
+
+// auditDetail describes the changes made by a request body as JSON
+func auditDetail(body any) string {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// auditDeniedRequest records a request turned away for failing authentication or lacking permissions, with the
+// actor left empty when the API key didn't belong to anyone
+func auditDeniedRequest(r *http.Request, actor string, reason string) {
+	recordAuditEvent(r, actor, "auth", r.Method+" "+r.URL.Path, auditDenied, reason)
+}
+
+func handleAudit(r *mux.Router) {
+	r.HandleFunc("/admin/audit", validatePerms(Administrator, ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var conditions []string
+		var args []any
+
+		for _, column := range []string{"actor", "target", "result"} {
+			if value := query.Get(column); value != "" {
+				conditions = append(conditions, column+" = ?")
+				args = append(args, value)
+			}
+		}
+
+		// Actions can be exact, like file.delete, or a whole group, like file.*
+		if action := query.Get("action"); action != "" {
+			if group, found := strings.CutSuffix(action, ".*"); found {
+				conditions = append(conditions, `action LIKE ? ESCAPE '\'`)
+				args = append(args, escapeLike(group)+".%")
+			} else {
+				conditions = append(conditions, "action = ?")
+				args = append(args, action)
+			}
+		}
+
+		if from := query.Get("from"); from != "" {
+			t, err := parseListTime(from, false)
+			if err != nil {
+				respondJSON(w, http.StatusBadRequest, map[string]any{"message": err.Error()})
+				return
+			}
+			conditions = append(conditions, "created_at >= ?")
+			args = append(args, t)
+		}
+		if to := query.Get("to"); to != "" {
+			t, err := parseListTime(to, true)
+			if err != nil {
+				respondJSON(w, http.StatusBadRequest, map[string]any{"message": err.Error()})
+				return
+			}
+			conditions = append(conditions, "created_at < ?")
+			args = append(args, t)
+		}
+
+		limit := defaultAuditLimit
+		if limitParam := query.Get("limit"); limitParam != "" {
+			n, err := strconv.Atoi(limitParam)
+			if err != nil || n <= 0 || n > maxAuditLimit {
+				respondJSON(w, http.StatusBadRequest, map[string]any{
+					"message": fmt.Sprintf("limit must be a whole number between 1 and %d", maxAuditLimit),
+				})
+				return
+			}
+			limit = n
+		}
+
+		// Events are listed newest first, so the cursor is the ID of the last event on the previous page
+		if cursor := query.Get("cursor"); cursor != "" {
+			id, err := strconv.ParseInt(cursor, 10, 64)
+			if err != nil {
+				respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid cursor"})
+				return
+			}
+			conditions = append(conditions, "id < ?")
+			args = append(args, id)
+		}
+
+		sqlQuery := "SELECT id, created_at, actor, action, target, ip, user_agent, result, detail FROM audit_events"
+		if len(conditions) > 0 {
+			sqlQuery += " WHERE " + strings.Join(conditions, " AND ")
+		}
+		sqlQuery += " ORDER BY id DESC LIMIT ?"
+		args = append(args, limit+1)
+
+		rows, err := db.Query(sqlQuery, args...)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Warn("Error querying audit events", "error", err)
+			return
+		}
+		defer func(rows *sql.Rows) {
+			if err = rows.Close(); err != nil {
+				logger.Request(r).Error("Error closing queried rows", "error", err)
+			}
+		}(rows)
+
+		events := []AuditEvent{}
+		for rows.Next() {
+			var event AuditEvent
+			if err = rows.Scan(
+				&event.Id, &event.CreatedAt, &event.Actor, &event.Action, &event.Target,
+				&event.IP, &event.UserAgent, &event.Result, &event.Detail,
+			); err != nil {
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Warn("Error reading queried row", "error", err)
+				return
+			}
+			events = append(events, event)
+		}
+		if err = rows.Err(); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Warn("Error querying audit events", "error", err)
+			return
+		}
+
+		var nextCursor *string
+		if len(events) > limit {
+			events = events[:limit]
+			cursor := strconv.FormatInt(events[len(events)-1].Id, 10)
+			nextCursor = &cursor
+		}
+
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message":    "Audit events fetched successfully",
+			"events":     events,
+			"nextCursor": nextCursor,
+		})
+	})).Methods("GET")
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gorilla/mux"
+)
+
+// Collections group files under their own share ID. A file can be in any number of collections,
+// and deleting a collection leaves its files alone
+
+type Collection struct {
+	Id        string `json:"id"`
+	Name      string `json:"name"`
+	Owner     string `json:"owner"`
+	CreatedAt string `json:"createdAt"`
+	FileCount int    `json:"fileCount"`
+}
+
+type CreateCollectionRequestBody struct {
+	Name string `json:"name"`
+}
+
+type AddCollectionFileRequestBody struct {
+	FileId string `json:"fileId"`
+}
+
+// PublicCollectionFile is a file as shown to anyone with a collection's link
+type PublicCollectionFile struct {
+	Id         string  `json:"id"`
+	Name       string  `json:"name"`
+	MimeType   string  `json:"mimeType"`
+	Size       int64   `json:"size"`
+	UploadedAt string  `json:"uploadedAt"`
+	Thumbnail  *string `json:"thumbnail"`
+
+	maxDownloads *int
+	version      int
+}
+
+const maxCollectionNameLength = 100
+
+func newCollectionId() (string, error) {
+	for {
+		collectionId := randomShareId()
+
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM collections WHERE id = ?", collectionId).Scan(&count); err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return collectionId, nil
+		}
+	}
+}
+
+// authorizeCollection checks a collection exists and belongs to the user making the request,
+// unless they can manage all files, responding with the reason if not
+func authorizeCollection(w http.ResponseWriter, r *http.Request, collectionId string) bool {
+	perms, err := getPermissions(r)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Request(r).Warn("Error parsing permissions header", "error", err)
+		return false
+	}
+
+	var owner string
+	if err = db.QueryRow("SELECT owner FROM collections WHERE id = ?", collectionId).Scan(&owner); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondJSON(w, http.StatusNotFound, map[string]any{"message": "Collection not found"})
+			return false
+		}
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Request(r).Error("Error querying collection owner from ID", "error", err)
+		return false
+	}
+
+	if perms < ReadWriteAll && owner != r.Header.Get("username") {
+		auditDeniedRequest(r, r.Header.Get("username"), "Not the collection's owner")
+		respondJSON(w, http.StatusUnauthorized, map[string]any{"message": "Insufficient permissions"})
+		return false
+	}
+	return true
+}
+
+// addToCollection adds a file to a collection, doing nothing if the collection has since been deleted
+func addToCollection(collectionId string, fileId string) error {
+	_, err := db.Exec(
+		`INSERT OR IGNORE INTO collection_files (collection_id, file_id, added_at)
+		SELECT ?, ?, datetime('now') WHERE EXISTS (SELECT 1 FROM collections WHERE id = ?)`,
+		collectionId, fileId, collectionId,
+	)
+	return err
+}
+
+// publicCollectionFiles lists the files anyone with the collection's link can download, leaving out private,
+// password-protected and expired files
+func publicCollectionFiles(collectionId string) ([]PublicCollectionFile, error) {
+	rows, err := db.Query(
+		`SELECT f.id, f.file_name, f.mime_type, f.size, f.uploaded_at, f.max_downloads, f.version
+		FROM collection_files cf JOIN files f ON f.id = cf.file_id
+		WHERE cf.collection_id = ? AND f.private = 0 AND f.password_hash IS NULL
+			AND (f.expires_at IS NULL OR f.expires_at > datetime('now'))
+		ORDER BY cf.added_at, f.file_name`,
+		collectionId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		if err = rows.Close(); err != nil {
+			logger.Error("Error closing queried rows", "error", err)
+		}
+	}(rows)
+
+	files := []PublicCollectionFile{}
+	for rows.Next() {
+		var file PublicCollectionFile
+		if err = rows.Scan(&file.Id, &file.Name, &file.MimeType, &file.Size, &file.UploadedAt, &file.maxDownloads, &file.version); err != nil {
+			return nil, err
+		}
+		if hasThumbnail(file.MimeType, file.maxDownloads) {
+			thumbnail := thumbnailURL(file.Id, file.version)
+			file.Thumbnail = &thumbnail
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+var collectionPage = template.Must(template.New("collection").Funcs(template.FuncMap{
+	"size": formatSize,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>{{.Collection.Name}} - Eulm Files</title>
+    <style>
+        body { font-family: system-ui, sans-serif; background: #111; color: #eee; margin: 2rem auto; max-width: 60rem; padding: 0 1rem; }
+        a { color: #e9d75a; }
+        ul { list-style: none; padding: 0; display: grid; grid-template-columns: repeat(auto-fill, minmax(10rem, 1fr)); gap: 1rem; }
+        li { background: #222; border-radius: 0.25rem; padding: 0.5rem; overflow-wrap: anywhere; }
+        img { display: block; width: 100%; height: 8rem; object-fit: contain; margin-bottom: 0.5rem; }
+        .size { color: #999; font-size: 0.875rem; }
+    </style>
+</head>
+<body>
+    <h1>{{.Collection.Name}}</h1>
+    <p>{{len .Files}} files{{if .Files}} - <a href="?download=zip">download all</a>{{end}}</p>
+    <ul>
+        {{range .Files}}
+        <li>
+            <a href="/{{.Id}}">{{if .Thumbnail}}<img src="{{.Thumbnail}}" alt="" loading="lazy">{{end}}{{.Name}}</a>
+            <div class="size">{{size .Size}}</div>
+        </li>
+        {{end}}
+    </ul>
+</body>
+</html>
+`))
+
+// zipEntryName makes a file name safe to extract, keeping only its last path element so it can't be written outside
+// the folder it's extracted to. Names with nothing usable left fall back to the file ID
+func zipEntryName(name string, fileId string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return fileId
+	}
+	return name
+}
+
+// writeCollectionZip streams a collection's files as a zip archive. Files with a download limit are left out,
+// since downloading the archive doesn't count towards them
+func writeCollectionZip(w http.ResponseWriter, name string, files []PublicCollectionFile) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", name+".zip"))
+
+	w, done := trackDownload(w)
+	defer done()
+
+	archive := zip.NewWriter(w)
+	usedNames := map[string]int{}
+
+	for _, file := range files {
+		if file.maxDownloads != nil {
+			continue
+		}
+
+		// Files with the same name get a number added so they don't overwrite each other when extracted
+		baseName := zipEntryName(file.Name, file.Id)
+		entryName := baseName
+		if count := usedNames[baseName]; count > 0 {
+			extension := ""
+			if i := strings.LastIndex(baseName, "."); i > 0 {
+				extension = baseName[i:]
+			}
+			entryName = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(baseName, extension), count+1, extension)
+		}
+		usedNames[baseName]++
+
+		header := &zip.FileHeader{Name: entryName, Method: zip.Deflate}
+		if uploadedAt, err := time.Parse(sqliteTimeFormat, file.UploadedAt); err == nil {
+			header.Modified = uploadedAt
+		}
+
+		entry, err := archive.CreateHeader(header)
+		if err != nil {
+			logger.Error("Error writing collection archive", "error", err)
+			return
+		}
+
+		filePath := blobPath(file.Id)
+		data, err := os.Open(filePath)
+		if err != nil {
+			logger.Error("Error opening file", "path", filePath, "error", err)
+			continue
+		}
+		_, err = io.Copy(entry, data)
+		if closeErr := data.Close(); closeErr != nil {
+			logger.Error("Error closing file", "path", filePath, "error", closeErr)
+		}
+		if err != nil {
+			logger.Error("Error writing collection archive", "error", err)
+			return
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		logger.Error("Error writing collection archive", "error", err)
+	}
+}
+
+func handleCollections(r *mux.Router) {
+	r.HandleFunc("/collections", validatePerms(ReadWriteSelf, ScopeUpload, func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get("username")
+
+		var body CreateCollectionRequestBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid JSON body"})
+			return
+		}
+
+		name := strings.TrimSpace(body.Name)
+		if name == "" || len(name) > maxCollectionNameLength {
+			respondJSON(w, http.StatusBadRequest, map[string]any{
+				"message": fmt.Sprintf("The collection name must be between 1 and %d characters", maxCollectionNameLength),
+			})
+			return
+		}
+
+		collectionId, err := newCollectionId()
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error generating collection ID", "error", err)
+			return
+		}
+
+		var collection Collection
+		if err = db.QueryRow(
+			"INSERT INTO collections (id, name, owner, created_at) VALUES (?, ?, ?, datetime('now')) RETURNING id, name, owner, created_at",
+			collectionId, name, username,
+		).Scan(&collection.Id, &collection.Name, &collection.Owner, &collection.CreatedAt); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error inserting collection into database", "error", err)
+			return
+		}
+
+		logger.Request(r).Info("Collection created", "collectionId", collectionId)
+		audit(r, "collection.create", collectionId, name)
+		respondJSON(w, http.StatusCreated, map[string]any{
+			"message":    "Collection created successfully",
+			"collection": collection,
+		})
+	})).Methods("POST")
+
+	r.HandleFunc("/collections", validatePerms(ReadWriteSelf, ScopeList, func(w http.ResponseWriter, r *http.Request) {
+		perms, err := getPermissions(r)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Warn("Error parsing permissions header", "error", err)
+			return
+		}
+
+		query := `SELECT c.id, c.name, c.owner, c.created_at, COUNT(cf.file_id)
+			FROM collections c LEFT JOIN collection_files cf ON cf.collection_id = c.id`
+		var args []any
+		if perms < ReadWriteAll {
+			query += " WHERE c.owner = ?"
+			args = append(args, r.Header.Get("username"))
+		}
+		query += " GROUP BY c.id ORDER BY c.created_at"
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Warn("Error querying collections", "error", err)
+			return
+		}
+		defer func(rows *sql.Rows) {
+			if err = rows.Close(); err != nil {
+				logger.Request(r).Error("Error closing queried rows", "error", err)
+			}
+		}(rows)
+
+		collections := []Collection{}
+		for rows.Next() {
+			var collection Collection
+			if err = rows.Scan(&collection.Id, &collection.Name, &collection.Owner, &collection.CreatedAt, &collection.FileCount); err != nil {
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Warn("Error reading queried row", "error", err)
+				return
+			}
+			collections = append(collections, collection)
+		}
+
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message":     "Collections fetched successfully",
+			"collections": collections,
+		})
+	})).Methods("GET")
+
+	// Lists every file in a collection for its owner, including the ones its public link leaves out
+	r.HandleFunc("/collections/{collectionId}", validatePerms(ReadWriteSelf, ScopeList, func(w http.ResponseWriter, r *http.Request) {
+		collectionId := mux.Vars(r)["collectionId"]
+		if !authorizeCollection(w, r, collectionId) {
+			return
+		}
+
+		var collection Collection
+		if err := db.QueryRow(
+			"SELECT id, name, owner, created_at, (SELECT COUNT(*) FROM collection_files WHERE collection_id = id) FROM collections WHERE id = ?",
+			collectionId,
+		).Scan(&collection.Id, &collection.Name, &collection.Owner, &collection.CreatedAt, &collection.FileCount); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying collection from ID", "error", err)
+			return
+		}
+
+		rows, err := db.Query(
+			"SELECT "+fileColumns+` FROM collection_files JOIN files ON files.id = collection_files.file_id
+			WHERE collection_files.collection_id = ? ORDER BY collection_files.added_at, files.file_name`,
+			collectionId,
+		)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Warn("Error querying collection files", "error", err)
+			return
+		}
+		defer func(rows *sql.Rows) {
+			if err = rows.Close(); err != nil {
+				logger.Request(r).Error("Error closing queried rows", "error", err)
+			}
+		}(rows)
+
+		files := []File{}
+		for rows.Next() {
+			file, err := scanFile(rows)
+			if err != nil {
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Warn("Error reading queried row", "error", err)
+				return
+			}
+			files = append(files, file)
+		}
+
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message":    "Collection fetched successfully",
+			"collection": collection,
+			"files":      files,
+		})
+	})).Methods("GET")
+
+	r.HandleFunc("/collections/{collectionId}", validatePerms(ReadWriteSelf, ScopeDelete, func(w http.ResponseWriter, r *http.Request) {
+		collectionId := mux.Vars(r)["collectionId"]
+		if !authorizeCollection(w, r, collectionId) {
+			return
+		}
+
+		if _, err := db.Exec("DELETE FROM collection_files WHERE collection_id = ?", collectionId); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error deleting collection files", "error", err)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM collections WHERE id = ?", collectionId); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error deleting collection", "error", err)
+			return
+		}
+
+		logger.Request(r).Info("Collection deleted")
+		audit(r, "collection.delete", collectionId, "")
+		respondJSON(w, http.StatusOK, map[string]any{"message": "Collection deleted successfully"})
+	})).Methods("DELETE")
+
+	r.HandleFunc("/collections/{collectionId}/files", validatePerms(ReadWriteSelf, ScopeUpload, func(w http.ResponseWriter, r *http.Request) {
+		collectionId := mux.Vars(r)["collectionId"]
+		if !authorizeCollection(w, r, collectionId) {
+			return
+		}
+
+		var body AddCollectionFileRequestBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid JSON body"})
+			return
+		}
+
+		perms, err := getPermissions(r)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Warn("Error parsing permissions header", "error", err)
+			return
+		}
+
+		var creator string
+		if err = db.QueryRow("SELECT creator FROM files WHERE id = ?", body.FileId).Scan(&creator); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				respondJSON(w, http.StatusNotFound, map[string]any{"message": "File not found"})
+				return
+			}
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying file creator from ID", "error", err)
+			return
+		}
+		if perms < ReadWriteAll && creator != r.Header.Get("username") {
+			auditDeniedRequest(r, r.Header.Get("username"), "Not the file's owner")
+			respondJSON(w, http.StatusUnauthorized, map[string]any{"message": "Insufficient permissions"})
+			return
+		}
+
+		if err = addToCollection(collectionId, body.FileId); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error adding file to collection", "error", err)
+			return
+		}
+
+		audit(r, "collection.add", collectionId, body.FileId)
+		respondJSON(w, http.StatusOK, map[string]any{"message": "File added to collection successfully"})
+	})).Methods("POST")
+
+	r.HandleFunc("/collections/{collectionId}/files/{fileId}", validatePerms(ReadWriteSelf, ScopeUpload, func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if !authorizeCollection(w, r, vars["collectionId"]) {
+			return
+		}
+
+		res, err := db.Exec("DELETE FROM collection_files WHERE collection_id = ? AND file_id = ?", vars["collectionId"], vars["fileId"])
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error removing file from collection", "error", err)
+			return
+		}
+		if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+			respondJSON(w, http.StatusNotFound, map[string]any{"message": "File isn't in this collection"})
+			return
+		}
+
+		audit(r, "collection.remove", vars["collectionId"], vars["fileId"])
+		respondJSON(w, http.StatusOK, map[string]any{"message": "File removed from collection successfully"})
+	})).Methods("DELETE")
+
+	// The public view of a collection, as JSON, a page for browsers or a zip of its files with ?download=zip
+	r.HandleFunc("/c/{collectionId}", func(w http.ResponseWriter, r *http.Request) {
+		collectionId := mux.Vars(r)["collectionId"]
+
+		var collection Collection
+		if err := db.QueryRow("SELECT id, name, created_at FROM collections WHERE id = ?", collectionId).Scan(
+			&collection.Id, &collection.Name, &collection.CreatedAt,
+		); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				respondJSON(w, http.StatusNotFound, map[string]any{"message": "Collection not found"})
+				return
+			}
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying collection from ID", "error", err)
+			return
+		}
+
+		files, err := publicCollectionFiles(collectionId)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying collection files", "error", err)
+			return
+		}
+
+		if download := r.URL.Query().Get("download"); download == "zip" || download == "1" || download == "true" {
+			writeCollectionZip(w, collection.Name, files)
+			return
+		}
+
+		if wantsHTML(r) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if err = collectionPage.Execute(w, map[string]any{"Collection": collection, "Files": files}); err != nil {
+				logger.Request(r).Error("Error rendering collection page", "error", err)
+			}
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message": "Collection fetched successfully",
+			"collection": map[string]any{
+				"id":        collection.Id,
+				"name":      collection.Name,
+				"createdAt": collection.CreatedAt,
+			},
+			"files": files,
+		})
+	}).Methods("GET")
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestZipEntryName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"photo.jpg", "photo.jpg"},
+		{"../../etc/passwd", "passwd"},
+		{"/etc/passwd", "passwd"},
+		{`..\..\Windows\win.ini`, "win.ini"},
+		{"dir/", "dir"},
+		{"..", "abc123"},
+		{".", "abc123"},
+		{"/", "abc123"},
+		{"", "abc123"},
+		{"a/b\x00c.txt", "bc.txt"},
+		{"\x01\x02", "abc123"},
+		{"name with spaces.txt", "name with spaces.txt"},
+	}
+
+	for _, test := range tests {
+		if got := zipEntryName(test.name, "abc123"); got != test.want {
+			t.Errorf("zipEntryName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
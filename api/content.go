@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"github.com/mattn/go-sqlite3"
+)
+
+// errVersionConflict means another request replaced a file's data while a replacement was being prepared
+var errVersionConflict = errors.New("the file's data was replaced by another request")
+
+// replaceFileContent swaps a file's data for the fully received upload at tempPath, keeping its ID and settings
+// and the previous data as an old version. The new data is only moved into place once the change is committed,
+// which is undone if the move fails. It returns errVersionConflict if another replacement got in first
+func replaceFileContent(fileId string, tempPath string) error {
+	info, err := os.Stat(tempPath)
+	if err != nil {
+		return err
+	}
+
+	var fileName string
+	var maxDownloads *int
+	var version int
+	if err = db.QueryRow(
+		"SELECT file_name, max_downloads, version FROM files WHERE id = ?", fileId,
+	).Scan(&fileName, &maxDownloads, &version); err != nil {
+		return err
+	}
+
+	mimeType, err := detectMimeType(tempPath, fileName)
+	if err != nil {
+		logger.Warn("Error detecting type of file", "fileId", fileId, "error", err)
+		mimeType = defaultMimeType
+	}
+
+	// Versions keep the checksum of their data, so make sure it's known before it's archived
+	if keepVersions > 0 {
+		if _, err = fileChecksum(fileId); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// What the row held before is kept so the change can be undone if the new data can't be moved into place
+	var previous fileContent
+	if err = tx.QueryRow(
+		"SELECT version, size, mime_type, checksum, modified_at FROM files WHERE id = ?", fileId,
+	).Scan(&previous.version, &previous.size, &previous.mimeType, &previous.checksum, &previous.modifiedAt); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if previous.version != version {
+		_ = tx.Rollback()
+		return errVersionConflict
+	}
+
+	var archivedPath string
+	if keepVersions > 0 {
+		archivedPath, err = archiveCurrentVersion(tx, fileId)
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			err = errVersionConflict
+		}
+	}
+	if err == nil {
+		// The next version only goes to the replacement that started from the current one
+		var res sql.Result
+		res, err = tx.Exec(
+			`UPDATE files SET size = ?, mime_type = ?, checksum = NULL, version = ?, modified_at = datetime('now')
+			WHERE id = ? AND version = ? AND NOT `+replaceQuotaCondition,
+			info.Size(), mimeType, version+1, fileId, version, fileId, info.Size(),
+		)
+		if err == nil {
+			if affected, affectedErr := res.RowsAffected(); affectedErr != nil {
+				err = affectedErr
+			} else if affected == 0 {
+				// The version was checked in this transaction, so it's the quota that stopped the update
+				err = errQuotaExceeded
+			}
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		removeArchivedVersion(archivedPath)
+		return err
+	}
+
+	if err = os.Rename(tempPath, blobPath(fileId)); err != nil {
+		if undoErr := undoReplace(fileId, previous, archivedPath != ""); undoErr != nil {
+			logger.Error("Error undoing replacement of file data", "fileId", fileId, "error", undoErr)
+		} else {
+			removeArchivedVersion(archivedPath)
+		}
+		return err
+	}
+
+	if err = pruneVersions(fileId); err != nil {
+		logger.Error("Error pruning old versions of file", "fileId", fileId, "error", err)
+	}
+	if err = removeThumbnails(fileId); err != nil {
+		logger.Error("Error deleting thumbnails of file", "fileId", fileId, "error", err)
+	}
+
+	runInBackground(func() {
+		if _, err := fileChecksum(fileId); err != nil {
+			logger.Warn("Error calculating checksum of file", "fileId", fileId, "error", err)
+		}
+		if hasThumbnail(mimeType, maxDownloads) {
+			if err := generateThumbnails(fileId, mimeType, thumbnailSizes); err != nil {
+				logger.Warn("Error making thumbnails for file", "fileId", fileId, "error", err)
+			}
+		}
+	})
+
+	return nil
+}
+
+// fileContent is what a file's row records about its current data
+type fileContent struct {
+	version    int
+	size       int64
+	mimeType   string
+	checksum   *string
+	modifiedAt *string
+}
+
+// undoReplace puts back what a file's row held before its data was replaced, for when the new data couldn't be
+// moved into place after the change was committed
+func undoReplace(fileId string, previous fileContent, archived bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(
+		"UPDATE files SET version = ?, size = ?, mime_type = ?, checksum = ?, modified_at = ? WHERE id = ? AND version = ?",
+		previous.version, previous.size, previous.mimeType, previous.checksum, previous.modifiedAt, fileId, previous.version+1,
+	); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if archived {
+		if _, err = tx.Exec("DELETE FROM file_versions WHERE file_id = ? AND version = ?", fileId, previous.version); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// removeArchivedVersion deletes the data archived for a replacement that didn't happen
+func removeArchivedVersion(path string) {
+	if path == "" {
+		return
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Error("Error deleting file", "path", path, "error", err)
+	}
+}
+
+// respondReplaceQuotaExceeded explains that replacing a file's data would take its creator over their quota
+func respondReplaceQuotaExceeded(w http.ResponseWriter, fileId string) {
+	var creator string
+	if err := db.QueryRow("SELECT creator FROM files WHERE id = ?", fileId).Scan(&creator); err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Error("Error querying file creator from ID", "error", err)
+		return
+	}
+	respondQuotaExceeded(w, creator, false)
+}
+
+// respondVersionConflict explains that another replacement of the file's data finished first
+func respondVersionConflict(w http.ResponseWriter) {
+	respondJSON(w, http.StatusConflict, map[string]any{
+		"message": "The file's data was replaced by another request at the same time - check it and try again",
+	})
+}
+
+func handleContent(r *mux.Router) {
+	// Replaces a file's data with the request body, so links to it keep working
+	replaceContent := validatePerms(ReadWriteSelf, ScopeModify, func(w http.ResponseWriter, r *http.Request) {
+		fileId := mux.Vars(r)["fileId"]
+
+		if !authorizeFileOwner(w, r, fileId) {
+			return
+		}
+
+		maxUploadSize, err := requestMaxUploadSize(r)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying upload limit", "error", err)
+			return
+		}
+		if r.ContentLength > maxUploadSize {
+			respondTooLarge(w, maxUploadSize)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+		tempFile, err := os.CreateTemp(partialDir, "replace-*.part")
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error creating temporary file", "error", err)
+			return
+		}
+		tempPath := tempFile.Name()
+
+		_, err = io.Copy(tempFile, r.Body)
+		if closeErr := tempFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = replaceFileContent(fileId, tempPath)
+		}
+		if err != nil {
+			if removeErr := os.Remove(tempPath); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+				logger.Request(r).Error("Error deleting file", "path", tempPath, "error", removeErr)
+			}
+
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				respondTooLarge(w, maxUploadSize)
+				return
+			}
+			if errors.Is(err, errQuotaExceeded) {
+				respondReplaceQuotaExceeded(w, fileId)
+				return
+			}
+			if errors.Is(err, errVersionConflict) {
+				respondVersionConflict(w)
+				return
+			}
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error replacing content of file", "error", err)
+			return
+		}
+
+		file, err := scanFile(db.QueryRow("SELECT "+fileColumns+" FROM files WHERE id = ?", fileId))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying file from ID", "error", err)
+			return
+		}
+
+		logger.Request(r).Info("File content replaced")
+		audit(r, "file.replace", fileId, fmt.Sprintf("version %d", file.Version))
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message": "File content replaced successfully",
+			"file":    file,
+		})
+	})
+	r.HandleFunc("/{fileId}", replaceContent).Methods("PUT")
+	r.HandleFunc("/{fileId}/content", replaceContent).Methods("PUT")
+}
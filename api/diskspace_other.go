@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// freeDiskSpace isn't supported outside Unix, so the disk space check fails with this error unless it's turned off
+func freeDiskSpace(path string) (int64, error) {
+	return 0, errors.New("reading free disk space isn't supported on this platform")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+)
+
+// Reasons a file ID was retired, recorded so its links can explain why they return 410 Gone
+const (
+	retiredExpired       = "expired"
+	retiredDownloadLimit = "download_limit"
+)
+
+// countingWriter tracks how much of a response body was written, so an interrupted download can be told apart
+// from a complete one
+type countingWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// claimDownload atomically uses up one of a file's remaining downloads, returning whether one was available
+// and whether it was the last
+func claimDownload(fileId string) (bool, bool, error) {
+	var last bool
+	err := db.QueryRow(
+		"UPDATE files SET download_count = download_count + 1 WHERE id = ? AND download_count < max_downloads RETURNING download_count >= max_downloads",
+		fileId,
+	).Scan(&last)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, last, nil
+}
+
+// releaseDownload gives back a download claimed by a transfer that didn't complete
+func releaseDownload(fileId string) error {
+	_, err := db.Exec("UPDATE files SET download_count = download_count - 1 WHERE id = ? AND download_count > 0", fileId)
+	return err
+}
+
+// retireFile deletes a file and remembers its ID, so links keep returning 410 Gone and the ID isn't reused for a
+// different file
+func retireFile(fileId string, reason string) error {
+	if err := removeFile(fileId); err != nil {
+		return err
+	}
+
+	_, err := db.Exec("INSERT OR IGNORE INTO expired_files (id, expired_at, reason) VALUES (?, datetime('now'), ?)", fileId, reason)
+	return err
+}
+
+// serveLimitedFile serves a file with a download limit, counting every full GET as one download and deleting the
+// file once the last one has been sent
+func serveLimitedFile(w http.ResponseWriter, r *http.Request, fileId string, fileName string, mimeType string, file *os.File) {
+	// Don't let caches hand out extra copies
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.Method == "HEAD" {
+		respondFile(w, r, fileName, mimeType, file)
+		return
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Request(r).Error("Error reading file info", "error", err)
+		return
+	}
+
+	// Partial and conditional requests would let a client fetch the file in pieces or skip the body,
+	// so every counted download sends the whole file
+	for _, header := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		r.Header.Del(header)
+	}
+
+	claimed, last, err := claimDownload(fileId)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Request(r).Error("Error claiming file download", "error", err)
+		return
+	}
+	if !claimed {
+		respondJSON(w, http.StatusGone, map[string]any{"message": "File has reached its download limit"})
+		return
+	}
+
+	counter := &countingWriter{ResponseWriter: w}
+	respondFile(counter, r, fileName, mimeType, file)
+
+	if counter.written < info.Size() {
+		if err = releaseDownload(fileId); err != nil {
+			logger.Request(r).Error("Error releasing file download", "error", err)
+		}
+		return
+	}
+
+	if last {
+		if err = retireFile(fileId, retiredDownloadLimit); err != nil {
+			logger.Request(r).Error("Error deleting file after its last download", "error", err)
+			return
+		}
+		logger.Request(r).Info("File reached its download limit and was deleted")
+		recordAuditEvent(nil, "", "file.delete", fileId, auditSuccess, "Download limit reached")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestClaimDownload(t *testing.T) {
+	setupTestDB(t)
+	if _, err := db.Exec(
+		"INSERT INTO files (id, file_name, uploaded_at, creator, max_downloads) VALUES ('abc123', 'a.txt', datetime('now'), 'Master', 3)",
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// More requests than downloads arrive at once, and only as many as the limit may get one
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claimed, last := 0, 0
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, isLast, err := claimDownload("abc123")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				claimed++
+			}
+			if isLast {
+				last++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if claimed != 3 || last != 1 {
+		t.Errorf("%d downloads claimed with %d marked as the last, want 3 and 1", claimed, last)
+	}
+
+	if err := releaseDownload("abc123"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, isLast, err := claimDownload("abc123"); err != nil || !ok || !isLast {
+		t.Errorf("claimDownload() after a release = %v, %v, %v, want the last download", ok, isLast, err)
+	}
+}
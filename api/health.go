@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// /healthz reports that the server is up and handling requests, for liveness probes. /readyz checks that the
+// database answers, that files can be written to the database directory and that there's enough free disk space,
+// responding with 503 Service Unavailable if any of them fail so traffic can be held back until they pass
+
+const dbDir = "db"
+
+// minFreeSpace is the free disk space needed in the database directory for the server to be ready, with 0 turning
+// the check off
+var minFreeSpace int64 = 1024 * 1024 * 1024 // 1GB
+
+const readinessTimeout = 5 * time.Second
+
+type HealthCheck struct {
+	Ok           bool   `json:"ok"`
+	Error        string `json:"error,omitempty"`
+	FreeBytes    *int64 `json:"freeBytes,omitempty"`
+	MinFreeBytes *int64 `json:"minFreeBytes,omitempty"`
+}
+
+func loadHealthOptions() error {
+	if value := os.Getenv("EULM_FILES_MIN_FREE_SPACE"); value != "" {
+		size, err := parseSize(value)
+		if err != nil {
+			return fmt.Errorf("EULM_FILES_MIN_FREE_SPACE: %w", err)
+		}
+		minFreeSpace = size
+	}
+	return nil
+}
+
+func checkDatabase(ctx context.Context) HealthCheck {
+	if err := db.PingContext(ctx); err != nil {
+		logger.Warn("Readiness check failed to reach the database", "error", err)
+		return HealthCheck{Error: "The database can't be reached"}
+	}
+	return HealthCheck{Ok: true}
+}
+
+// checkStorage writes and removes a small file to make sure uploads can be stored
+func checkStorage() HealthCheck {
+	failed := func(err error) HealthCheck {
+		logger.Warn("Readiness check failed to write to the database directory", "path", dbDir, "error", err)
+		return HealthCheck{Error: "The database directory isn't writable"}
+	}
+
+	file, err := os.CreateTemp(dbDir, ".readyz-*")
+	if err != nil {
+		return failed(err)
+	}
+	defer func() {
+		if err := os.Remove(file.Name()); err != nil {
+			logger.Error("Error removing readiness check file", "path", file.Name(), "error", err)
+		}
+	}()
+
+	if _, err = file.WriteString("ok"); err != nil {
+		_ = file.Close()
+		return failed(err)
+	}
+	if err = file.Close(); err != nil {
+		return failed(err)
+	}
+	return HealthCheck{Ok: true}
+}
+
+func checkDiskSpace() HealthCheck {
+	free, err := freeDiskSpace(dbDir)
+	if err != nil {
+		logger.Warn("Readiness check failed to read free disk space", "path", dbDir, "error", err)
+		return HealthCheck{Error: "Free disk space couldn't be read"}
+	}
+
+	check := HealthCheck{Ok: free >= minFreeSpace, FreeBytes: &free, MinFreeBytes: &minFreeSpace}
+	if !check.Ok {
+		check.Error = fmt.Sprintf("Only %s of disk space is free, less than the %s needed", formatSize(free), formatSize(minFreeSpace))
+	}
+	return check
+}
+
+func handleHealth(r *mux.Router) {
+	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		respondJSON(w, http.StatusOK, map[string]any{"message": "OK"})
+	}).Methods("GET", "HEAD")
+
+	r.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		checks := map[string]HealthCheck{
+			"database": checkDatabase(ctx),
+			"storage":  checkStorage(),
+		}
+		if minFreeSpace > 0 {
+			checks["diskSpace"] = checkDiskSpace()
+		}
+
+		status, message := http.StatusOK, "Ready"
+		for _, check := range checks {
+			if !check.Ok {
+				status, message = http.StatusServiceUnavailable, "Not ready"
+				break
+			}
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		respondJSON(w, status, map[string]any{"message": message, "checks": checks})
+	}).Methods("GET", "HEAD")
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+)
+
+// FileInfo describes a file without downloading it. The fields after Version are only filled in
+// for the file's owner, as are Checksum and DownloadCount for files with a download limit
+type FileInfo struct {
+	Id            string  `json:"id"`
+	Name          string  `json:"name"`
+	Size          int64   `json:"size"`
+	MimeType      string  `json:"mimeType"`
+	Checksum      *string `json:"checksum,omitempty"`
+	Creator       string  `json:"creator"`
+	UploadedAt    string  `json:"uploadedAt"`
+	ExpiresAt     *string `json:"expiresAt"`
+	DownloadCount *int    `json:"downloadCount,omitempty"`
+	Thumbnail     *string `json:"thumbnail"`
+	Version       int     `json:"version"`
+
+	Owner        bool      `json:"owner"`
+	MaxDownloads *int      `json:"maxDownloads,omitempty"`
+	HasPassword  *bool     `json:"hasPassword,omitempty"`
+	Private      *bool     `json:"private,omitempty"`
+	Description  *string   `json:"description,omitempty"`
+	Tags         *[]string `json:"tags,omitempty"`
+	Collections  *[]string `json:"collections,omitempty"`
+}
+
+// fileChecksum returns a file's SHA-256 checksum as "sha256:<hex>", working it out and saving it
+// for files uploaded before checksums were stored
+func fileChecksum(fileId string) (string, error) {
+	var checksum *string
+	var version int
+	if err := db.QueryRow("SELECT checksum, version FROM files WHERE id = ?", fileId).Scan(&checksum, &version); err != nil {
+		return "", err
+	}
+	if checksum != nil {
+		return *checksum, nil
+	}
+
+	filePath := blobPath(fileId)
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer func(file *os.File) {
+		if err = file.Close(); err != nil {
+			logger.Error("Error closing file", "path", filePath, "error", err)
+		}
+	}(file)
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	sum := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+
+	// The content may have been replaced while it was being hashed, in which case the sum is thrown away and the
+	// current content hashed instead
+	result, err := db.Exec("UPDATE files SET checksum = ? WHERE id = ? AND version = ? AND checksum IS NULL", sum, fileId, version)
+	if err != nil {
+		return "", err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return "", err
+	} else if updated == 0 {
+		return fileChecksum(fileId)
+	}
+	return sum, nil
+}
+
+func fileCollections(fileId string) ([]string, error) {
+	rows, err := db.Query("SELECT collection_id FROM collection_files WHERE file_id = ? ORDER BY added_at", fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) {
+		if err = rows.Close(); err != nil {
+			logger.Error("Error closing queried rows", "error", err)
+		}
+	}(rows)
+
+	collections := []string{}
+	for rows.Next() {
+		var collectionId string
+		if err = rows.Scan(&collectionId); err != nil {
+			return nil, err
+		}
+		collections = append(collections, collectionId)
+	}
+	return collections, rows.Err()
+}
+
+func handleInfo(r *mux.Router) {
+	// Anyone who could download a file can see its info, and looking doesn't count as a download
+	r.HandleFunc("/{fileId}/info", func(w http.ResponseWriter, r *http.Request) {
+		fileId := mux.Vars(r)["fileId"]
+
+		stored, ok := authorizeDownload(w, r, fileId)
+		if !ok {
+			return
+		}
+
+		file, err := scanFile(db.QueryRow("SELECT "+fileColumns+" FROM files WHERE id = ?", fileId))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying file from ID", "error", err)
+			return
+		}
+
+		info := FileInfo{
+			Id:         file.Id,
+			Name:       file.Name,
+			Size:       file.Size,
+			MimeType:   file.MimeType,
+			Creator:    file.Creator,
+			UploadedAt: file.UploadedAt,
+			ExpiresAt:  file.ExpiresAt,
+			Thumbnail:  file.Thumbnail,
+			Version:    file.Version,
+		}
+
+		// The checksum would let anyone confirm a guess of a download-limited file's content, and the count shows
+		// how many downloads are left, so only the owner sees them
+		owner := checkOwnerKey(r, stored.creator)
+		if owner || file.MaxDownloads == nil {
+			checksum, err := fileChecksum(fileId)
+			if err != nil {
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Error("Error calculating checksum of file", "error", err)
+				return
+			}
+			info.Checksum = &checksum
+			info.DownloadCount = &file.DownloadCount
+		}
+
+		if owner {
+			collections, err := fileCollections(fileId)
+			if err != nil {
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Error("Error querying file collections", "error", err)
+				return
+			}
+
+			info.Owner = true
+			info.MaxDownloads = file.MaxDownloads
+			info.HasPassword = &file.HasPassword
+			info.Private = &file.Private
+			info.Description = &file.Description
+			info.Tags = &file.Tags
+			info.Collections = &collections
+			w.Header().Set("Cache-Control", "private, no-store")
+		}
+
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message": "File info fetched successfully",
+			"file":    info,
+		})
+	}).Methods("GET")
+}
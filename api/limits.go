@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+)
+
+// The largest file a user can upload comes from their own override if they have one, then the setting for their
+// permission level, then the server-wide default
+
+var defaultMaxUploadSize int64 = 500 * 1024 * 1024 // 500MB
+var permissionMaxUploadSizes = map[PermissionLevel]int64{}
+
+// multipartOverhead leaves room for the form boundaries and fields sent alongside the file to /upload
+const multipartOverhead = 1024 * 1024
+
+var permissionMaxUploadSizeVars = map[PermissionLevel]string{
+	ReadWriteSelf: "EULM_FILES_MAX_UPLOAD_SIZE_SELF",
+	ReadWriteAll:  "EULM_FILES_MAX_UPLOAD_SIZE_ALL",
+	Administrator: "EULM_FILES_MAX_UPLOAD_SIZE_ADMIN",
+}
+
+func loadUploadLimits() error {
+	if value := os.Getenv("EULM_FILES_MAX_UPLOAD_SIZE"); value != "" {
+		size, err := parseSize(value)
+		if err != nil {
+			return fmt.Errorf("EULM_FILES_MAX_UPLOAD_SIZE: %w", err)
+		}
+		defaultMaxUploadSize = size
+	}
+
+	for perms, name := range permissionMaxUploadSizeVars {
+		if value := os.Getenv(name); value != "" {
+			size, err := parseSize(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			permissionMaxUploadSizes[perms] = size
+		}
+	}
+
+	return nil
+}
+
+func maxUploadSizeFor(username string, perms PermissionLevel) (int64, error) {
+	var userMaxUploadSize *int64
+	if err := db.QueryRow("SELECT max_upload_size FROM users WHERE username = ?", username).Scan(&userMaxUploadSize); err != nil {
+		return 0, err
+	}
+
+	if userMaxUploadSize != nil {
+		return *userMaxUploadSize, nil
+	}
+	if size, ok := permissionMaxUploadSizes[perms]; ok {
+		return size, nil
+	}
+	return defaultMaxUploadSize, nil
+}
+
+// requestMaxUploadSize finds the upload limit for the user making an authenticated request
+func requestMaxUploadSize(r *http.Request) (int64, error) {
+	perms, err := getPermissions(r)
+	if err != nil {
+		return 0, err
+	}
+	return maxUploadSizeFor(r.Header.Get("username"), perms)
+}
+
+func respondTooLarge(w http.ResponseWriter, maxUploadSize int64) {
+	respondJSON(w, http.StatusRequestEntityTooLarge, map[string]any{
+		"message":       fmt.Sprintf("File is too large - the limit is %d bytes", maxUploadSize),
+		"maxUploadSize": maxUploadSize,
+	})
+}
+
+func handleLimits(r *mux.Router) {
+	r.HandleFunc("/limits", validatePerms(ReadWriteSelf, NoScopes, func(w http.ResponseWriter, r *http.Request) {
+		maxUploadSize, err := requestMaxUploadSize(r)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying upload limit", "error", err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message":       "Limits fetched successfully",
+			"maxUploadSize": maxUploadSize,
+		})
+	})).Methods("GET")
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Logs are written to stdout as coloured text or JSON, and optionally to a file that's rotated once it gets too
+// large. Lines logged while handling a request carry its ID, user and route variables as fields
+
+const levelFatal = slog.LevelError + 4
+
+const (
+	defaultLogFileMaxSize = 100 << 20
+	defaultLogFileBackups = 5
+)
+
+// internalHeaders are set on requests by validatePerms, so they're cleared from incoming requests
+var internalHeaders = []string{"username", "permissions", "tokenId", "tokenName", "scopes"}
+
+var requestIdRegex = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,64}$`)
+
+type Logger struct {
+	slog *slog.Logger
+}
+
+func (l *Logger) Debug(msg string, args ...any) {
+	l.slog.Debug(msg, args...)
+}
+
+func (l *Logger) Info(msg string, args ...any) {
+	l.slog.Info(msg, args...)
+}
+
+func (l *Logger) Warn(msg string, args ...any) {
+	l.slog.Warn(msg, args...)
+}
+
+func (l *Logger) Error(msg string, args ...any) {
+	l.slog.Error(msg, args...)
+}
+
+func (l *Logger) Fatal(msg string, args ...any) {
+	l.slog.Log(context.Background(), levelFatal, msg, args...)
+	os.Exit(1)
+}
+
+// Request returns a logger that adds the request's ID, the authenticated user and the route's variables, like the
+// file ID, to everything it logs. A nil request, for work the server does by itself, gives back l unchanged
+func (l *Logger) Request(r *http.Request) *Logger {
+	if r == nil {
+		return l
+	}
+
+	args := []any{"requestId", r.Header.Get("X-Request-ID")}
+	if username := r.Header.Get("username"); username != "" {
+		args = append(args, "user", username)
+	}
+
+	vars := mux.Vars(r)
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		args = append(args, name, vars[name])
+	}
+
+	return &Logger{slog: l.slog.With(args...)}
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid level %q - use debug, info, warn or error", s)
+}
+
+// newLogHandler makes a handler writing in the given format, with colours only used for text written to a terminal
+func newLogHandler(w io.Writer, format string, level slog.Level, colour bool) slog.Handler {
+	if format == "json" {
+		return slog.NewJSONHandler(w, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+				if attr.Key == slog.LevelKey && len(groups) == 0 && attr.Value.Any() == levelFatal {
+					attr.Value = slog.StringValue("FATAL")
+				}
+				return attr
+			},
+		})
+	}
+	return newTextHandler(w, level, colour)
+}
+
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0 && os.Getenv("NO_COLOR") == ""
+}
+
+func newLogger() *Logger {
+	return &Logger{slog: slog.New(newLogHandler(os.Stdout, "text", slog.LevelInfo, isTerminal(os.Stdout)))}
+}
+
+var logger = newLogger()
+
+// loadLogging replaces the default logger with one configured by the environment
+func loadLogging() error {
+	format := strings.ToLower(os.Getenv("EULM_FILES_LOG_FORMAT"))
+	if format == "" {
+		format = "text"
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("EULM_FILES_LOG_FORMAT: invalid format %q - use text or json", format)
+	}
+
+	level := slog.LevelInfo
+	if value := os.Getenv("EULM_FILES_LOG_LEVEL"); value != "" {
+		var err error
+		if level, err = parseLogLevel(value); err != nil {
+			return fmt.Errorf("EULM_FILES_LOG_LEVEL: %w", err)
+		}
+	}
+
+	handlers := []slog.Handler{newLogHandler(os.Stdout, format, level, isTerminal(os.Stdout))}
+
+	if path := os.Getenv("EULM_FILES_LOG_FILE"); path != "" {
+		maxSize := int64(defaultLogFileMaxSize)
+		if value := os.Getenv("EULM_FILES_LOG_FILE_MAX_SIZE"); value != "" {
+			var err error
+			if maxSize, err = parseSize(value); err != nil || maxSize <= 0 {
+				return fmt.Errorf("EULM_FILES_LOG_FILE_MAX_SIZE: invalid size %q", value)
+			}
+		}
+
+		backups := defaultLogFileBackups
+		if value := os.Getenv("EULM_FILES_LOG_FILE_BACKUPS"); value != "" {
+			var err error
+			if backups, err = strconv.Atoi(value); err != nil || backups < 0 {
+				return fmt.Errorf("EULM_FILES_LOG_FILE_BACKUPS: invalid count %q", value)
+			}
+		}
+
+		file, err := openRotatingFile(path, maxSize, backups)
+		if err != nil {
+			return fmt.Errorf("EULM_FILES_LOG_FILE: %w", err)
+		}
+		handlers = append(handlers, newLogHandler(file, format, level, false))
+	}
+
+	if len(handlers) == 1 {
+		logger = &Logger{slog: slog.New(handlers[0])}
+	} else {
+		logger = &Logger{slog: slog.New(multiHandler(handlers))}
+	}
+	return nil
+}
+
+// requestIdMiddleware gives each request an ID to find its log lines by, keeping one set by a proxy in front of the
+// API if it looks valid. The ID is sent back in the X-Request-ID header
+func requestIdMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, header := range internalHeaders {
+			r.Header.Del(header)
+		}
+
+		requestId := r.Header.Get("X-Request-ID")
+		if !requestIdRegex.MatchString(requestId) {
+			id := make([]byte, 8)
+			_, _ = rand.Read(id)
+			requestId = hex.EncodeToString(id)
+			r.Header.Set("X-Request-ID", requestId)
+		}
+		w.Header().Set("X-Request-ID", requestId)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// textHandler writes log lines like "INF 02/01/2006 15:04:05 - Message key=value", in colour if enabled
+type textHandler struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	level  slog.Level
+	colour bool
+
+	// attrs holds the formatted attributes added by WithAttrs, and group the prefix for keys added after WithGroup
+	attrs string
+	group string
+}
+
+type levelStyle struct {
+	name   string
+	col    string
+	dimCol string
+}
+
+func colourCode(r, g, b uint8) string {
+	return fmt.Sprintf("\x1b[38;2;%d;%d;%dm", r, g, b)
+}
+
+var levelStyles = map[slog.Level]levelStyle{
+	slog.LevelDebug: {"DBG", colourCode(150, 150, 150), colourCode(120, 120, 120)},
+	slog.LevelInfo:  {"INF", colourCode(233, 215, 90), colourCode(202, 191, 111)},
+	slog.LevelWarn:  {"WRN", colourCode(255, 135, 47), colourCode(216, 140, 84)},
+	slog.LevelError: {"ERR", colourCode(255, 70, 50), colourCode(216, 98, 86)},
+	levelFatal:      {"FTL", colourCode(181, 29, 29), colourCode(169, 72, 72)},
+}
+
+const resetCode = "\x1b[0m"
+
+func newTextHandler(w io.Writer, level slog.Level, colour bool) *textHandler {
+	return &textHandler{w: w, mu: &sync.Mutex{}, level: level, colour: colour}
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *textHandler) Handle(_ context.Context, record slog.Record) error {
+	style := levelStyles[slog.LevelDebug]
+	for _, level := range []slog.Level{slog.LevelInfo, slog.LevelWarn, slog.LevelError, levelFatal} {
+		if record.Level >= level {
+			style = levelStyles[level]
+		}
+	}
+
+	var attrs strings.Builder
+	attrs.WriteString(h.attrs)
+	record.Attrs(func(attr slog.Attr) bool {
+		appendTextAttr(&attrs, h.group, attr)
+		return true
+	})
+
+	t := record.Time.Format("02/01/2006 15:04:05")
+	var line string
+	if h.colour {
+		line = fmt.Sprintf("%s%s %s - %s%s%s%s%s\n", style.dimCol, style.name, t, style.col, record.Message, style.dimCol, attrs.String(), resetCode)
+	} else {
+		line = fmt.Sprintf("%s %s - %s%s\n", style.name, t, record.Message, attrs.String())
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, line)
+	return err
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var formatted strings.Builder
+	formatted.WriteString(h.attrs)
+	for _, attr := range attrs {
+		appendTextAttr(&formatted, h.group, attr)
+	}
+
+	handler := *h
+	handler.attrs = formatted.String()
+	return &handler
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	handler := *h
+	handler.group += name + "."
+	return &handler
+}
+
+// appendTextAttr writes an attribute as " key=value", quoting values that would be ambiguous otherwise
+func appendTextAttr(b *strings.Builder, group string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			group += attr.Key + "."
+		}
+		for _, groupAttr := range attr.Value.Group() {
+			appendTextAttr(b, group, groupAttr)
+		}
+		return
+	}
+
+	var value string
+	if attr.Value.Kind() == slog.KindTime {
+		value = attr.Value.Time().Format(time.RFC3339)
+	} else {
+		value = attr.Value.String()
+	}
+	if value == "" || strings.ContainsAny(value, " \"=\n\t") {
+		value = strconv.Quote(value)
+	}
+
+	b.WriteString(" " + group + attr.Key + "=" + value)
+}
+
+// multiHandler sends log records to several handlers, like stdout and a log file
+type multiHandler []slog.Handler
+
+func (h multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h multiHandler) Handle(ctx context.Context, record slog.Record) error {
+	var firstErr error
+	for _, handler := range h {
+		if !handler.Enabled(ctx, record.Level) {
+			continue
+		}
+		if err := handler.Handle(ctx, record.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (h multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (h multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(h))
+	for i, handler := range h {
+		handlers[i] = handler.WithGroup(name)
+	}
+	return handlers
+}
+
+// rotatingFile is a log file that's moved to <path>.1 once it reaches its maximum size, shifting older logs along to
+// <path>.2 and so on, and deleting those past the number of backups kept
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	err := f.shiftBackups()
+	if openErr := f.open(); err == nil {
+		err = openErr
+	}
+	return err
+}
+
+func (f *rotatingFile) shiftBackups() error {
+	if f.backups == 0 {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.Remove(fmt.Sprintf("%s.%d", f.path, f.backups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := f.backups - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(f.path, f.path+".1")
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file != nil && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// Lines are still written to the current file if it could be reopened, rather than being lost
+			fmt.Fprintln(os.Stderr, "Error rotating log file:", err)
+		}
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
+	"syscall"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -17,15 +20,58 @@ var db *sql.DB
 var masterKey string
 var port = ":8080"
 
+const masterUsername = "Master"
+
+// minMasterKeyLength keeps the Master key, which is hashed like generated keys, hard enough to guess
+const minMasterKeyLength = 32
+
+// partialDir holds uploads that haven't been fully received yet
+const partialDir = "db/partial"
+
 func loadEnvVars() {
 	if err := godotenv.Load(".env"); err != nil {
 		logger.Fatal("Error loading .env files")
 	}
 
+	if err := loadLogging(); err != nil {
+		logger.Fatal("Error loading logging options", "error", err)
+	}
+
 	var ok bool
 	if masterKey, ok = os.LookupEnv("EULM_FILES_MASTER_KEY"); !ok {
 		logger.Fatal("Environment variable EULM_FILES_MASTER_KEY not found")
 	}
+	if len(masterKey) < minMasterKeyLength {
+		logger.Fatal("EULM_FILES_MASTER_KEY is too short, generate one with e.g. openssl rand -hex 32", "minLength", minMasterKeyLength)
+	}
+
+	if err := loadUploadLimits(); err != nil {
+		logger.Fatal("Error loading upload size limits", "error", err)
+	}
+
+	if err := loadThumbnailSizes(); err != nil {
+		logger.Fatal("Error loading thumbnail sizes", "error", err)
+	}
+
+	if err := loadVersionRetention(); err != nil {
+		logger.Fatal("Error loading version retention", "error", err)
+	}
+
+	if err := loadHealthOptions(); err != nil {
+		logger.Fatal("Error loading health check options", "error", err)
+	}
+
+	if err := loadMetricsOptions(); err != nil {
+		logger.Fatal("Error loading metrics options", "error", err)
+	}
+
+	if err := loadShutdownTimeout(); err != nil {
+		logger.Fatal("Error loading shutdown timeout", "error", err)
+	}
+
+	if err := loadRateLimits(); err != nil {
+		logger.Fatal("Error loading rate limits", "error", err)
+	}
 
 	if portVar := os.Getenv("EULM_FILES_PORT"); regexp.MustCompile(`^:\d{4}$`).MatchString(portVar) {
 		port = portVar
@@ -37,16 +83,16 @@ func loadEnvVars() {
 func initDB() {
 	var err error
 
-	if err = os.MkdirAll("db", os.ModePerm); err != nil {
-		logger.Fatal("Error creating database directory:", err.Error())
+	if err = os.MkdirAll(partialDir, os.ModePerm); err != nil {
+		logger.Fatal("Error creating database directory", "error", err)
 	}
 
 	// SQLite driver creates the database file as long as its parent directory exists
 	if db, err = sql.Open("sqlite3", "db/main.db"); err != nil {
-		logger.Fatal("Error opening database:", err.Error())
+		logger.Fatal("Error opening database", "error", err)
 	}
 	if err = db.Ping(); err != nil {
-		logger.Fatal("Error connecting to database:", err.Error())
+		logger.Fatal("Error connecting to database", "error", err)
 	}
 
 	if _, err = db.Exec(`
@@ -54,30 +100,229 @@ func initDB() {
             id TEXT NOT NULL,
             file_name TEXT NOT NULL,
 			uploaded_at TEXT NOT NULL,
-			creator TEXT NOT NULL
+			creator TEXT NOT NULL,
+            mime_type TEXT NOT NULL DEFAULT '',
+            expires_at TEXT,
+            max_downloads INTEGER,
+            download_count INTEGER NOT NULL DEFAULT 0,
+            password_hash TEXT,
+            private INTEGER NOT NULL DEFAULT 0,
+            size INTEGER NOT NULL DEFAULT 0,
+            description TEXT NOT NULL DEFAULT '',
+            checksum TEXT,
+            version INTEGER NOT NULL DEFAULT 1,
+            modified_at TEXT
         );
+        CREATE TABLE IF NOT EXISTS file_versions (
+            file_id TEXT NOT NULL,
+            version INTEGER NOT NULL,
+            size INTEGER NOT NULL,
+            mime_type TEXT NOT NULL,
+            checksum TEXT,
+            created_at TEXT NOT NULL,
+            replaced_at TEXT NOT NULL,
+            PRIMARY KEY (file_id, version)
+        );
+        CREATE INDEX IF NOT EXISTS files_id ON files (id);
+        CREATE INDEX IF NOT EXISTS files_creator ON files (creator);
+        CREATE INDEX IF NOT EXISTS files_uploaded_at ON files (uploaded_at);
+        CREATE TABLE IF NOT EXISTS file_tags (
+            file_id TEXT NOT NULL,
+            tag TEXT NOT NULL,
+            PRIMARY KEY (file_id, tag)
+        );
+        CREATE INDEX IF NOT EXISTS file_tags_tag ON file_tags (tag);
+        CREATE TABLE IF NOT EXISTS expired_files (
+            id TEXT PRIMARY KEY,
+            expired_at TEXT NOT NULL,
+            reason TEXT NOT NULL DEFAULT 'expired'
+        );
+        CREATE TABLE IF NOT EXISTS collections (
+            id TEXT PRIMARY KEY,
+            name TEXT NOT NULL,
+            owner TEXT NOT NULL,
+            created_at TEXT NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS collection_files (
+            collection_id TEXT NOT NULL,
+            file_id TEXT NOT NULL,
+            added_at TEXT NOT NULL,
+            PRIMARY KEY (collection_id, file_id)
+        );
+        CREATE INDEX IF NOT EXISTS collection_files_file_id ON collection_files (file_id);
         CREATE TABLE IF NOT EXISTS users (
-            api_key TEXT NOT NULL,
             username TEXT UNIQUE NOT NULL,
-            permissions INTEGER NOT NULL
+            permissions INTEGER NOT NULL,
+            disabled INTEGER NOT NULL DEFAULT 0,
+            quota_bytes INTEGER,
+            quota_files INTEGER,
+            max_upload_size INTEGER
+        );
+        CREATE TABLE IF NOT EXISTS tokens (
+            id INTEGER PRIMARY KEY,
+            username TEXT NOT NULL,
+            name TEXT NOT NULL,
+            scopes INTEGER NOT NULL,
+            key_prefix TEXT NOT NULL,
+            key_salt TEXT NOT NULL,
+            key_hash TEXT NOT NULL,
+            created_at TEXT NOT NULL,
+            expires_at TEXT,
+            last_used_at TEXT
+        );
+        CREATE INDEX IF NOT EXISTS tokens_key_prefix ON tokens (key_prefix);
+        CREATE TABLE IF NOT EXISTS uploads (
+            id TEXT PRIMARY KEY,
+            username TEXT NOT NULL,
+            file_name TEXT NOT NULL,
+            length INTEGER NOT NULL,
+            metadata TEXT NOT NULL,
+            options TEXT NOT NULL DEFAULT '{}',
+            created_at TEXT NOT NULL,
+            updated_at TEXT,
+            file_id TEXT
         );
     `); err != nil {
-		logger.Fatal("Error creating tables:", err.Error())
+		logger.Fatal("Error creating tables", "error", err)
 	}
 
-	if _, err = db.Exec("DELETE FROM users WHERE username = ?", "Master"); err != nil {
-		logger.Fatal("Error deleting existing Master user(s):", err.Error())
+	if err = addColumn("users", "disabled", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		logger.Fatal("Error migrating users table", "error", err)
+	}
+	if err = addColumn("files", "mime_type", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		logger.Fatal("Error migrating files table", "error", err)
+	}
+	if err = addColumn("files", "expires_at", "TEXT"); err != nil {
+		logger.Fatal("Error migrating files table", "error", err)
+	}
+	if err = addColumn("files", "max_downloads", "INTEGER"); err != nil {
+		logger.Fatal("Error migrating files table", "error", err)
+	}
+	if err = addColumn("files", "download_count", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		logger.Fatal("Error migrating files table", "error", err)
+	}
+	if err = addColumn("files", "password_hash", "TEXT"); err != nil {
+		logger.Fatal("Error migrating files table", "error", err)
+	}
+	if err = addColumn("files", "private", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		logger.Fatal("Error migrating files table", "error", err)
+	}
+	if err = addColumn("files", "size", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		logger.Fatal("Error migrating files table", "error", err)
+	}
+	if err = addColumn("files", "description", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		logger.Fatal("Error migrating files table", "error", err)
+	}
+	if err = addColumn("files", "checksum", "TEXT"); err != nil {
+		logger.Fatal("Error migrating files table", "error", err)
+	}
+	if err = addColumn("files", "version", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		logger.Fatal("Error migrating files table", "error", err)
+	}
+	if err = addColumn("files", "modified_at", "TEXT"); err != nil {
+		logger.Fatal("Error migrating files table", "error", err)
+	}
+	if err = addColumn("users", "quota_bytes", "INTEGER"); err != nil {
+		logger.Fatal("Error migrating users table", "error", err)
 	}
-	if _, err = db.Exec("INSERT INTO users (api_key, username, permissions) VALUES (?, ?, ?)", masterKey, "Master", 3); err != nil {
-		logger.Fatal("Error inserting new Master user:", err.Error())
+	if err = addColumn("users", "quota_files", "INTEGER"); err != nil {
+		logger.Fatal("Error migrating users table", "error", err)
+	}
+	if err = addColumn("users", "max_upload_size", "INTEGER"); err != nil {
+		logger.Fatal("Error migrating users table", "error", err)
+	}
+	if err = addColumn("expired_files", "reason", "TEXT NOT NULL DEFAULT 'expired'"); err != nil {
+		logger.Fatal("Error migrating expired files table", "error", err)
+	}
+	if err = addColumn("uploads", "options", "TEXT NOT NULL DEFAULT '{}'"); err != nil {
+		logger.Fatal("Error migrating uploads table", "error", err)
+	}
+	if err = addColumn("uploads", "updated_at", "TEXT"); err != nil {
+		logger.Fatal("Error migrating uploads table", "error", err)
+	}
+	if err = backfillMimeTypes(); err != nil {
+		logger.Fatal("Error detecting types of existing files", "error", err)
+	}
+	if err = backfillFileSizes(); err != nil {
+		logger.Fatal("Error recording sizes of existing files", "error", err)
+	}
+	if err = initSearchIndex(); err != nil {
+		logger.Fatal("Error creating search index", "error", err)
+	}
+	if err = initAuditLog(); err != nil {
+		logger.Fatal("Error creating audit log", "error", err)
+	}
+	// Migrations recorded in user_version have to run in order of their versions
+	if err = migrateTokenScopes(); err != nil {
+		logger.Fatal("Error migrating token scopes", "error", err)
+	}
+	if err = migrateUserKeys(); err != nil {
+		logger.Fatal("Error migrating API keys to tokens", "error", err)
+	}
+
+	if _, err = db.Exec("DELETE FROM users WHERE username = ?", masterUsername); err != nil {
+		logger.Fatal("Error deleting existing Master user(s)", "error", err)
+	}
+	if _, err = db.Exec("INSERT INTO users (username, permissions) VALUES (?, ?)", masterUsername, Administrator); err != nil {
+		logger.Fatal("Error inserting new Master user", "error", err)
+	}
+	if err = syncMasterToken(); err != nil {
+		logger.Fatal("Error storing Master token", "error", err)
 	}
 
 	logger.Info("Database initialised successfully")
 }
 
+func hasColumn(table, column string) (bool, error) {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// addColumn adds a column to a table created by an older version of the API, doing nothing if it already exists
+func addColumn(table, column, definition string) error {
+	exists, err := hasColumn(table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// runMigration makes a one-off change to the data of a database from an older version, recording version as its
+// user_version so it only happens once
+func runMigration(version int, migrate func(tx *sql.Tx) error) error {
+	var current int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&current); err != nil {
+		return err
+	}
+	if current >= version {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if err = migrate(tx); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func closeDB() {
 	if err := db.Close(); err != nil {
-		logger.Fatal("Error closing database connection:", err.Error())
+		logger.Fatal("Error closing database connection", "error", err)
 	}
 }
 
@@ -85,18 +330,61 @@ func main() {
 	loadEnvVars()
 
 	initDB()
-	defer closeDB()
+
+	if err := loadSigningSecret(); err != nil {
+		logger.Fatal("Error loading signing secret", "error", err)
+	}
+	if err := removeLeftoverTempFiles(); err != nil {
+		logger.Error("Error removing partial files left by interrupted requests", "error", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	runInBackground(func() { runSweeper(ctx) })
 
 	r := mux.NewRouter()
+	r.Use(requestIdMiddleware)
+	r.Use(metricsMiddleware)
+	r.Use(rateLimitMiddleware)
 
+	handleHealth(r)
+	handleAdmin(r)
+	handleAudit(r)
+	handleMetrics(r)
+	handleTokens(r)
+	handleTus(r)
+	handleShare(r)
+	handleUsage(r)
+	handleLimits(r)
+	handleThumbnails(r)
+	handleInfo(r)
+	handleContent(r)
+	handleVersions(r)
+	handleCollections(r)
+	handleSearch(r)
 	handleApi(r)
 
 	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		respondJSON(w, http.StatusNotFound, map[string]any{"message": "Route not found"})
 	})
 
-	logger.Info(fmt.Sprintf("Server starting on port %s", port))
-	if err := http.ListenAndServe(port, r); err != nil {
-		logger.Fatal("Error starting server:", err.Error())
+	server := &http.Server{Addr: port, Handler: trackRequests(r)}
+	go listen(server, "Server")
+
+	metricsServer := newMetricsServer()
+	if metricsServer != nil {
+		go listen(metricsServer, "Metrics server")
+	}
+
+	<-ctx.Done()
+	// A second signal stops the server straight away
+	stop()
+
+	if shutdown(server, metricsServer) {
+		closeDB()
+	} else {
+		logger.Warn("Leaving the database open as work using it is still running")
 	}
+	logger.Info("Server stopped")
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+const testMasterKey = "test master key that is long enough"
+
+// setupTestDB runs initDB in a temporary directory, so each test gets an empty database with a Master user
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	masterKey = testMasterKey
+	initDB()
+
+	t.Cleanup(func() {
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+		if err := os.Chdir(dir); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// addTestUser creates a user with a token that has the given scopes, returning the token's API key
+func addTestUser(t *testing.T, username string, perms PermissionLevel, scopes Scope) string {
+	t.Helper()
+
+	if _, err := db.Exec("INSERT INTO users (username, permissions) VALUES (?, ?)", username, perms); err != nil {
+		t.Fatal(err)
+	}
+	_, apiKey, err := createToken(db, username, "test", scopes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apiKey
+}
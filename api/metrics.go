@@ -0,0 +1,326 @@
+package main
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// /metrics reports request, transfer, storage and authentication metrics in the Prometheus text format. It's only
+// served when EULM_FILES_METRICS_TOKEN or EULM_FILES_METRICS_ADDR is set, either behind the token on the main port
+// or on a separate address that can be kept private
+
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// uploadRoutes are the routes whose request bodies count as uploaded data
+var uploadRoutes = map[string]bool{
+	"POST /upload":          true,
+	"PATCH /tus/{uploadId}": true,
+	"PUT /{fileId}":         true,
+	"PUT /{fileId}/content": true,
+}
+
+var metricsToken string
+var metricsAddr string
+
+type requestLabels struct {
+	route  string
+	method string
+	status int
+}
+
+type requestStats struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+type metricsRegistry struct {
+	mu           sync.Mutex
+	requests     map[requestLabels]*requestStats
+	authFailures map[string]uint64
+
+	uploadedBytes   atomic.Int64
+	downloadedBytes atomic.Int64
+	activeUploads   atomic.Int64
+	activeDownloads atomic.Int64
+}
+
+var metrics = &metricsRegistry{
+	requests:     map[requestLabels]*requestStats{},
+	authFailures: map[string]uint64{},
+}
+
+func loadMetricsOptions() error {
+	metricsToken = os.Getenv("EULM_FILES_METRICS_TOKEN")
+	metricsAddr = os.Getenv("EULM_FILES_METRICS_ADDR")
+	if metricsToken != "" && len(metricsToken) < 16 {
+		return fmt.Errorf("EULM_FILES_METRICS_TOKEN: the token must be at least 16 characters")
+	}
+	return nil
+}
+
+func (m *metricsRegistry) observeRequest(labels requestLabels, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats, ok := m.requests[labels]
+	if !ok {
+		stats = &requestStats{buckets: make([]uint64, len(requestDurationBuckets))}
+		m.requests[labels] = stats
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range requestDurationBuckets {
+		if seconds <= bound {
+			stats.buckets[i]++
+		}
+	}
+	stats.sum += seconds
+	stats.count++
+}
+
+// authFailure counts a request turned away by validatePerms, with reasons like invalid_key and expired_key
+func (m *metricsRegistry) authFailure(reason string) {
+	m.mu.Lock()
+	m.authFailures[reason]++
+	m.mu.Unlock()
+}
+
+// escapeLabel escapes a label value as the text format requires
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// write writes every metric, querying the database for the storage totals
+func (m *metricsRegistry) write(w io.Writer) error {
+	var storedFiles, storedBytes, versionBytes int64
+	if err := db.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(size), 0), (SELECT COALESCE(SUM(size), 0) FROM file_versions) FROM files",
+	).Scan(&storedFiles, &storedBytes, &versionBytes); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+
+	m.mu.Lock()
+	labels := make([]requestLabels, 0, len(m.requests))
+	for l := range m.requests {
+		labels = append(labels, l)
+	}
+	slices.SortFunc(labels, func(a, b requestLabels) int {
+		return cmp.Or(strings.Compare(a.route, b.route), strings.Compare(a.method, b.method), cmp.Compare(a.status, b.status))
+	})
+
+	b.WriteString("# HELP eulm_files_http_requests_total Requests handled, by route, method and status.\n")
+	b.WriteString("# TYPE eulm_files_http_requests_total counter\n")
+	for _, l := range labels {
+		fmt.Fprintf(&b, "eulm_files_http_requests_total{route=\"%s\",method=\"%s\",status=\"%d\"} %d\n",
+			escapeLabel(l.route), l.method, l.status, m.requests[l].count)
+	}
+
+	b.WriteString("# HELP eulm_files_http_request_duration_seconds Time taken to handle requests, by route, method and status.\n")
+	b.WriteString("# TYPE eulm_files_http_request_duration_seconds histogram\n")
+	for _, l := range labels {
+		stats := m.requests[l]
+		prefix := fmt.Sprintf("route=\"%s\",method=\"%s\",status=\"%d\"", escapeLabel(l.route), l.method, l.status)
+		for i, bound := range requestDurationBuckets {
+			fmt.Fprintf(&b, "eulm_files_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", prefix, formatFloat(bound), stats.buckets[i])
+		}
+		fmt.Fprintf(&b, "eulm_files_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", prefix, stats.count)
+		fmt.Fprintf(&b, "eulm_files_http_request_duration_seconds_sum{%s} %s\n", prefix, formatFloat(stats.sum))
+		fmt.Fprintf(&b, "eulm_files_http_request_duration_seconds_count{%s} %d\n", prefix, stats.count)
+	}
+
+	reasons := make([]string, 0, len(m.authFailures))
+	for reason := range m.authFailures {
+		reasons = append(reasons, reason)
+	}
+	slices.Sort(reasons)
+
+	b.WriteString("# HELP eulm_files_auth_failures_total Requests rejected for failing authentication, by reason.\n")
+	b.WriteString("# TYPE eulm_files_auth_failures_total counter\n")
+	for _, reason := range reasons {
+		fmt.Fprintf(&b, "eulm_files_auth_failures_total{reason=\"%s\"} %d\n", escapeLabel(reason), m.authFailures[reason])
+	}
+	m.mu.Unlock()
+
+	fmt.Fprintf(&b, `# HELP eulm_files_uploaded_bytes_total Bytes received in upload request bodies.
+# TYPE eulm_files_uploaded_bytes_total counter
+eulm_files_uploaded_bytes_total %d
+# HELP eulm_files_downloaded_bytes_total Bytes of files and archives sent to clients.
+# TYPE eulm_files_downloaded_bytes_total counter
+eulm_files_downloaded_bytes_total %d
+# HELP eulm_files_active_transfers Uploads and downloads in progress.
+# TYPE eulm_files_active_transfers gauge
+eulm_files_active_transfers{direction="upload"} %d
+eulm_files_active_transfers{direction="download"} %d
+# HELP eulm_files_stored_files Files currently stored.
+# TYPE eulm_files_stored_files gauge
+eulm_files_stored_files %d
+# HELP eulm_files_stored_bytes Total size of stored files, not including old versions.
+# TYPE eulm_files_stored_bytes gauge
+eulm_files_stored_bytes %d
+# HELP eulm_files_version_bytes Total size of old versions of files.
+# TYPE eulm_files_version_bytes gauge
+eulm_files_version_bytes %d
+`,
+		m.uploadedBytes.Load(), m.downloadedBytes.Load(), m.activeUploads.Load(), m.activeDownloads.Load(),
+		storedFiles, storedBytes, versionBytes,
+	)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// statusRecorder remembers the status of a response for the request metrics
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom lets files be sent with the underlying writer's optimisations, like sendfile
+func (w *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingBody counts the bytes read from an upload's request body
+type countingBody struct {
+	io.ReadCloser
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	metrics.uploadedBytes.Add(int64(n))
+	return n, err
+}
+
+// downloadWriter counts the bytes written for a download
+type downloadWriter struct {
+	http.ResponseWriter
+}
+
+func (w downloadWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	metrics.downloadedBytes.Add(int64(n))
+	return n, err
+}
+
+func (w downloadWriter) ReadFrom(src io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, src)
+	metrics.downloadedBytes.Add(n)
+	return n, err
+}
+
+func (w downloadWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// trackDownload counts what's written to w towards the downloaded bytes, with the returned function marking the end
+// of the transfer
+func trackDownload(w http.ResponseWriter) (http.ResponseWriter, func()) {
+	metrics.activeDownloads.Add(1)
+	return downloadWriter{w}, func() {
+		metrics.activeDownloads.Add(-1)
+	}
+}
+
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		if uploadRoutes[r.Method+" "+route] {
+			metrics.activeUploads.Add(1)
+			defer metrics.activeUploads.Add(-1)
+			r.Body = countingBody{r.Body}
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		metrics.observeRequest(requestLabels{route: route, method: r.Method, status: recorder.status}, time.Since(start))
+	})
+}
+
+// metricsHandler serves the metrics, checking the token if one is set
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if metricsToken != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(metricsToken)) != 1 {
+			respondJSON(w, http.StatusUnauthorized, map[string]any{"message": "Invalid metrics token"})
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := metrics.write(w); err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Request(r).Error("Error writing metrics", "error", err)
+	}
+}
+
+// handleMetrics serves /metrics on the main router when it's protected by a token and not given its own address
+func handleMetrics(r *mux.Router) {
+	if metricsToken == "" || metricsAddr != "" {
+		return
+	}
+	r.HandleFunc("/metrics", metricsHandler).Methods("GET")
+}
+
+// newMetricsServer serves /metrics on its own address, or is nil if one isn't set
+func newMetricsServer() *http.Server {
+	if metricsAddr == "" {
+		return nil
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	return &http.Server{Addr: metricsAddr, Handler: router}
+}
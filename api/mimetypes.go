@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// inlineMimeTypes can be displayed by browsers and chat apps without letting the file run scripts on our origin
+var inlineMimeTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/avif":      true,
+	"image/bmp":       true,
+	"video/mp4":       true,
+	"video/webm":      true,
+	"video/ogg":       true,
+	"video/quicktime": true,
+	"audio/mpeg":      true,
+	"audio/ogg":       true,
+	"audio/wav":       true,
+	"audio/wave":      true,
+	"audio/webm":      true,
+	"audio/aac":       true,
+	"audio/flac":      true,
+	"audio/mp4":       true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+const defaultMimeType = "application/octet-stream"
+
+func isInlineMimeType(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	return err == nil && inlineMimeTypes[mediaType]
+}
+
+// detectMimeType sniffs the type of a file from its contents,
+// only trusting the file extension when the contents don't match anything more specific
+func detectMimeType(filePath string, fileName string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer func(file *os.File) {
+		if err = file.Close(); err != nil {
+			logger.Error("Error closing file", "path", filePath, "error", err)
+		}
+	}(file)
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	mimeType := http.DetectContentType(buf[:n])
+	if mimeType == defaultMimeType || mimeType == "text/plain; charset=utf-8" {
+		if byExtension := mime.TypeByExtension(filepath.Ext(fileName)); byExtension != "" {
+			mimeType = byExtension
+		}
+	}
+
+	return mimeType, nil
+}
+
+// backfillMimeTypes detects the type of files uploaded before types were recorded
+func backfillMimeTypes() error {
+	rows, err := db.Query("SELECT id, file_name FROM files WHERE mime_type = ''")
+	if err != nil {
+		return err
+	}
+
+	files := map[string]string{}
+	for rows.Next() {
+		var fileId, fileName string
+		if err = rows.Scan(&fileId, &fileName); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		files[fileId] = fileName
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+
+	for fileId, fileName := range files {
+		mimeType, err := detectMimeType(blobPath(fileId), fileName)
+		if err != nil {
+			logger.Warn("Error detecting type of file", "fileId", fileId, "error", err)
+			mimeType = defaultMimeType
+		}
+		if _, err = db.Exec("UPDATE files SET mime_type = ? WHERE id = ?", mimeType, fileId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /list pages through files with a cursor holding the sort value and ID of the last file on the previous page,
+// so pages stay consistent while files are being uploaded and deleted
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listSortColumns maps the sort options to the columns they order by
+var listSortColumns = map[string]string{
+	"name":     "files.file_name COLLATE NOCASE",
+	"uploaded": "files.uploaded_at",
+	"size":     "files.size",
+}
+
+type listCursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Value string `json:"v"`
+	Id    string `json:"i"`
+}
+
+type listQuery struct {
+	sort       string
+	order      string
+	limit      int
+	cursor     *listCursor
+	conditions []string
+	args       []any
+}
+
+func encodeListCursor(cursor listCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(s string) (*listCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+
+	var cursor listCursor
+	if err = json.Unmarshal(data, &cursor); err != nil || cursor.Id == "" {
+		return nil, errors.New("Invalid cursor")
+	}
+	return &cursor, nil
+}
+
+// parseListTime reads a time as RFC 3339 or a date, with endOfDay moving dates to the start of the next day so
+// ranges include the whole of their last day
+func parseListTime(value string, endOfDay bool) (string, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC().Format(sqliteTimeFormat), nil
+	}
+
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return "", fmt.Errorf("Invalid time %q - use RFC 3339 or a date, e.g. 2006-01-02", value)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t.Format(sqliteTimeFormat), nil
+}
+
+// parseListQuery reads the sorting, filtering and paging options for /list
+func parseListQuery(query url.Values) (listQuery, error) {
+	list := listQuery{sort: "uploaded", limit: defaultListLimit}
+
+	if sort := query.Get("sort"); sort != "" {
+		if _, ok := listSortColumns[sort]; !ok {
+			return list, errors.New("Invalid sort - use name, uploaded or size")
+		}
+		list.sort = sort
+	}
+
+	// Names are listed A to Z by default, and everything else newest or largest first
+	list.order = "desc"
+	if list.sort == "name" {
+		list.order = "asc"
+	}
+	if order := query.Get("order"); order != "" {
+		if order != "asc" && order != "desc" {
+			return list, errors.New("Invalid order - use asc or desc")
+		}
+		list.order = order
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > maxListLimit {
+			return list, fmt.Errorf("limit must be a whole number between 1 and %d", maxListLimit)
+		}
+		list.limit = n
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		var err error
+		if list.cursor, err = decodeListCursor(cursor); err != nil {
+			return list, err
+		}
+		if list.cursor.Sort != list.sort || list.cursor.Order != list.order {
+			return list, errors.New("The cursor is from a list with a different sort order")
+		}
+	}
+
+	if creator := query.Get("creator"); creator != "" {
+		list.conditions = append(list.conditions, "files.creator = ?")
+		list.args = append(list.args, creator)
+	}
+
+	if from := query.Get("from"); from != "" {
+		t, err := parseListTime(from, false)
+		if err != nil {
+			return list, err
+		}
+		list.conditions = append(list.conditions, "files.uploaded_at >= ?")
+		list.args = append(list.args, t)
+	}
+	if to := query.Get("to"); to != "" {
+		t, err := parseListTime(to, true)
+		if err != nil {
+			return list, err
+		}
+		list.conditions = append(list.conditions, "files.uploaded_at < ?")
+		list.args = append(list.args, t)
+	}
+
+	// Types can be exact, like image/png, or a whole category, like image/*
+	if mimeType := strings.ToLower(strings.TrimSpace(query.Get("type"))); mimeType != "" {
+		if category, found := strings.CutSuffix(mimeType, "/*"); found {
+			list.conditions = append(list.conditions, `files.mime_type LIKE ? ESCAPE '\'`)
+			list.args = append(list.args, escapeLike(category)+"/%")
+		} else {
+			list.conditions = append(list.conditions, `(files.mime_type = ? OR files.mime_type LIKE ? ESCAPE '\')`)
+			list.args = append(list.args, mimeType, escapeLike(mimeType)+";%")
+		}
+	}
+
+	return list, nil
+}
+
+// sql builds the query for a page of files, fetching one extra file to tell whether there's another page
+func (list listQuery) sql() (string, []any, error) {
+	column := listSortColumns[list.sort]
+	conditions, args := list.conditions, list.args
+
+	comparison := "<"
+	if list.order == "asc" {
+		comparison = ">"
+	}
+
+	if list.cursor != nil {
+		var value any = list.cursor.Value
+		if list.sort == "size" {
+			size, err := strconv.ParseInt(list.cursor.Value, 10, 64)
+			if err != nil {
+				return "", nil, errors.New("Invalid cursor")
+			}
+			value = size
+		}
+		conditions = append(conditions, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND files.id %[2]s ?))", column, comparison))
+		args = append(args, value, value, list.cursor.Id)
+	}
+
+	query := "SELECT " + fileColumns + " FROM files"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, files.id %s LIMIT ?", column, list.order, list.order)
+	args = append(args, list.limit+1)
+
+	return query, args, nil
+}
+
+// nextCursor points to the page after the given file
+func (list listQuery) nextCursor(last File) string {
+	cursor := listCursor{Sort: list.sort, Order: list.order, Id: last.Id}
+	switch list.sort {
+	case "name":
+		cursor.Value = last.Name
+	case "uploaded":
+		cursor.Value = last.UploadedAt
+	case "size":
+		cursor.Value = strconv.FormatInt(last.Size, 10)
+	}
+	return encodeListCursor(cursor)
+}
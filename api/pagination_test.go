@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDecodeListCursor(t *testing.T) {
+	cursor := listCursor{Sort: "size", Order: "desc", Value: "1024", Id: "abc123"}
+
+	decoded, err := decodeListCursor(encodeListCursor(cursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *decoded != cursor {
+		t.Errorf("decodeListCursor() = %+v, want %+v", *decoded, cursor)
+	}
+
+	for _, invalid := range []string{
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("not json")),
+		base64.RawURLEncoding.EncodeToString([]byte(`{"s":"size","o":"desc","v":"1024"}`)),
+		base64.RawURLEncoding.EncodeToString([]byte(`[]`)),
+	} {
+		if _, err = decodeListCursor(invalid); err == nil {
+			t.Errorf("decodeListCursor(%q) accepted an invalid cursor", invalid)
+		}
+	}
+}
+
+func TestParseListQueryCursor(t *testing.T) {
+	cursor := encodeListCursor(listCursor{Sort: "size", Order: "desc", Value: "1024", Id: "abc123"})
+
+	if _, err := parseListQuery(url.Values{"sort": {"size"}, "cursor": {cursor}}); err != nil {
+		t.Errorf("parseListQuery() error = %v", err)
+	}
+	if _, err := parseListQuery(url.Values{"sort": {"name"}, "cursor": {cursor}}); err == nil {
+		t.Error("parseListQuery() accepted a cursor from a different sort")
+	}
+	if _, err := parseListQuery(url.Values{"sort": {"size"}, "order": {"asc"}, "cursor": {cursor}}); err == nil {
+		t.Error("parseListQuery() accepted a cursor from a different order")
+	}
+}
+
+func TestListQuerySQLCursor(t *testing.T) {
+	// Cursor values are only ever passed as arguments, and sizes have to be numbers
+	injected := encodeListCursor(listCursor{Sort: "name", Order: "asc", Value: "x' OR 1=1 --", Id: "abc123"})
+	list, err := parseListQuery(url.Values{"sort": {"name"}, "cursor": {injected}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, err := list.sql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args[0] != "x' OR 1=1 --" || strings.Contains(query, "OR 1=1") {
+		t.Errorf("cursor value ended up in the query: %s", query)
+	}
+
+	badSize := encodeListCursor(listCursor{Sort: "size", Order: "desc", Value: "big", Id: "abc123"})
+	list, err = parseListQuery(url.Values{"sort": {"size"}, "cursor": {badSize}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = list.sql(); err == nil {
+		t.Error("sql() accepted a size cursor that isn't a number")
+	}
+}
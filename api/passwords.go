@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// File passwords are chosen by people rather than generated like API keys, so they're stretched with PBKDF2
+// to make guessing them from a leaked database slow
+
+const passwordIterations = 100_000
+const passwordHeader = "Eulm-File-Password"
+
+func pbkdf2SHA256(password []byte, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+
+	return result
+}
+
+// hashFilePassword returns the password hash in the form "pbkdf2-sha256$iterations$salt$hash"
+func hashFilePassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash := pbkdf2SHA256([]byte(password), salt, passwordIterations)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations, hex.EncodeToString(salt), hex.EncodeToString(hash)), nil
+}
+
+func checkFilePassword(password string, passwordHash string) bool {
+	parts := strings.Split(passwordHash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(password), salt, iterations), expected) == 1
+}
+
+// Browsers that enter the password get a cookie so the file can be viewed and reloaded without asking again.
+// It's signed with the file's password hash, which never leaves the server, so changing the password
+// also invalidates it
+
+func passwordCookieName(fileId string) string {
+	return "eulm_file_" + fileId
+}
+
+func passwordCookieValue(fileId string, passwordHash string) string {
+	mac := hmac.New(sha256.New, []byte(passwordHash))
+	mac.Write([]byte(fileId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+var passwordPage = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <meta name="robots" content="noindex">
+    <title>Password required - Eulm Files</title>
+    <style>
+        body { font-family: system-ui, sans-serif; background: #111; color: #eee; display: flex; justify-content: center; align-items: center; min-height: 100vh; margin: 0; }
+        form { display: flex; flex-direction: column; gap: 0.75rem; width: 18rem; }
+        input, button { font: inherit; padding: 0.5rem; border-radius: 0.25rem; border: 1px solid #444; }
+        input { background: #222; color: inherit; }
+        button { background: #e9d75a; color: #111; cursor: pointer; }
+        .error { color: #f66; margin: 0; }
+    </style>
+</head>
+<body>
+    <form method="post">
+        <h1>Password required</h1>
+        <label for="password">Enter the password to open this file</label>
+        <input id="password" name="password" type="password" autocomplete="current-password" autofocus required>
+        {{if .}}<p class="error">{{.}}</p>{{end}}
+        <button type="submit">Open file</button>
+    </form>
+</body>
+</html>
+`))
+
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// respondPasswordRequired asks for a file's password, with a form for browsers and JSON for everything else
+func respondPasswordRequired(w http.ResponseWriter, r *http.Request, message string) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if !wantsHTML(r) {
+		respondJSON(w, http.StatusUnauthorized, map[string]any{"message": message})
+		return
+	}
+
+	formError := ""
+	if message != "Password required" {
+		formError = message
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	if err := passwordPage.Execute(w, formError); err != nil {
+		logger.Request(r).Error("Error rendering password page", "error", err)
+	}
+}
+
+// checkFileAccess reports whether a request to a password-protected file has the password,
+// either in a header or query for scripts or in a cookie set by the password page
+func checkFileAccess(w http.ResponseWriter, r *http.Request, fileId string, passwordHash string) bool {
+	password := r.Header.Get(passwordHeader)
+	if password == "" {
+		password = r.URL.Query().Get("password")
+	}
+
+	if password != "" {
+		if !checkFilePassword(password, passwordHash) {
+			respondPasswordRequired(w, r, "Incorrect password")
+			return false
+		}
+		w.Header().Set("Cache-Control", "private, no-store")
+		return true
+	}
+
+	if cookie, err := r.Cookie(passwordCookieName(fileId)); err == nil &&
+		hmac.Equal([]byte(cookie.Value), []byte(passwordCookieValue(fileId, passwordHash))) {
+		w.Header().Set("Cache-Control", "private, no-store")
+		return true
+	}
+
+	respondPasswordRequired(w, r, "Password required")
+	return false
+}
+
+// handlePasswordForm checks a password submitted from the password page, setting the access cookie
+// and sending the browser back to the file if it's correct
+func handlePasswordForm(w http.ResponseWriter, r *http.Request, fileId string, passwordHash string) {
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+	if err := r.ParseForm(); err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid form data"})
+		return
+	}
+
+	if !checkFilePassword(r.PostFormValue("password"), passwordHash) {
+		respondPasswordRequired(w, r, "Incorrect password")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     passwordCookieName(fileId),
+		Value:    passwordCookieValue(fileId, passwordHash),
+		Path:     "/" + fileId,
+		MaxAge:   24 * 60 * 60,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	target := "/" + fileId
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+)
+
+type Usage struct {
+	Bytes        int64  `json:"bytes"`
+	VersionBytes int64  `json:"versionBytes"`
+	Files        int64  `json:"files"`
+	QuotaBytes   *int64 `json:"quotaBytes"`
+	QuotaFiles   *int64 `json:"quotaFiles"`
+}
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// storedBytes is the total size of a user's files and their old versions, for a query on users aliased as u
+const storedBytes = `(SELECT COALESCE(SUM(size), 0) FROM files WHERE creator = u.username)
+	+ (SELECT COALESCE(SUM(fv.size), 0) FROM file_versions fv JOIN files vf ON vf.id = fv.file_id WHERE vf.creator = u.username)`
+
+// quotaCondition is true when adding a file of the given size would take the user over either quota.
+// Its parameters are the username followed by the new file's size
+const quotaCondition = `EXISTS (
+	SELECT 1 FROM users u WHERE u.username = ? AND (
+		(u.quota_bytes IS NOT NULL AND ` + storedBytes + ` + ? > u.quota_bytes)
+		OR (u.quota_files IS NOT NULL AND (SELECT COUNT(*) FROM files WHERE creator = u.username) >= u.quota_files)
+	)
+)`
+
+// replaceQuotaCondition is true when replacing a file's data with data of the given size would take its creator
+// over their storage quota, once any data being kept as an old version has been recorded.
+// Its parameters are the file's ID followed by the new size
+const replaceQuotaCondition = `EXISTS (
+	SELECT 1 FROM files f JOIN users u ON u.username = f.creator WHERE f.id = ? AND u.quota_bytes IS NOT NULL
+		AND ` + storedBytes + ` - f.size + ? > u.quota_bytes
+)`
+
+func getUsage(username string) (Usage, error) {
+	var usage Usage
+	err := db.QueryRow(
+		`SELECT `+storedBytes+`,
+			(SELECT COALESCE(SUM(fv.size), 0) FROM file_versions fv JOIN files vf ON vf.id = fv.file_id WHERE vf.creator = u.username),
+			(SELECT COUNT(*) FROM files WHERE creator = u.username),
+			quota_bytes, quota_files
+		FROM users u WHERE username = ?`,
+		username,
+	).Scan(&usage.Bytes, &usage.VersionBytes, &usage.Files, &usage.QuotaBytes, &usage.QuotaFiles)
+	return usage, err
+}
+
+// checkQuota reports whether the user has room for another file of the given size
+func checkQuota(username string, size int64) (bool, error) {
+	var exceeded bool
+	if err := db.QueryRow("SELECT "+quotaCondition, username, size).Scan(&exceeded); err != nil {
+		return false, err
+	}
+	return !exceeded, nil
+}
+
+// respondQuotaExceeded explains which of the user's quotas an upload would go over. Only new files
+// count towards the file quota, not ones replacing an existing file's data
+func respondQuotaExceeded(w http.ResponseWriter, username string, newFile bool) {
+	usage, err := getUsage(username)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Error("Error querying storage usage", "error", err)
+		return
+	}
+
+	message := "Storage quota exceeded"
+	if newFile && usage.QuotaFiles != nil && usage.Files >= *usage.QuotaFiles {
+		message = fmt.Sprintf("File quota exceeded - you have %d of %d files", usage.Files, *usage.QuotaFiles)
+	} else if usage.QuotaBytes != nil {
+		message = fmt.Sprintf("Storage quota exceeded - you're using %d of %d bytes", usage.Bytes, *usage.QuotaBytes)
+		if usage.VersionBytes > 0 {
+			message += fmt.Sprintf(", including %d in old versions of files", usage.VersionBytes)
+		}
+	}
+
+	respondJSON(w, http.StatusInsufficientStorage, map[string]any{"message": message, "usage": usage})
+}
+
+// backfillFileSizes records the size of files uploaded before sizes were stored
+func backfillFileSizes() error {
+	rows, err := db.Query("SELECT id FROM files WHERE size = 0")
+	if err != nil {
+		return err
+	}
+
+	var fileIds []string
+	for rows.Next() {
+		var fileId string
+		if err = rows.Scan(&fileId); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		fileIds = append(fileIds, fileId)
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+
+	for _, fileId := range fileIds {
+		info, err := os.Stat(blobPath(fileId))
+		if err != nil {
+			logger.Warn("Error reading size of file", "fileId", fileId, "error", err)
+			continue
+		}
+		if _, err = db.Exec("UPDATE files SET size = ? WHERE id = ?", info.Size(), fileId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func handleUsage(r *mux.Router) {
+	r.HandleFunc("/usage", validatePerms(ReadWriteSelf, NoScopes, func(w http.ResponseWriter, r *http.Request) {
+		usage, err := getUsage(r.Header.Get("username"))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying storage usage", "error", err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message": "Usage fetched successfully",
+			"usage":   usage,
+		})
+	})).Methods("GET")
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests are rate limited with token buckets, one per API key for authenticated requests and one per client IP
+// for everything else. A bucket holds up to limit requests and refills completely over window. Keys that haven't
+// been seen recently also use up a request for their IP before they're looked up, so made up keys can't make the
+// server query the database for every request
+
+type rateLimit struct {
+	limit  int
+	window time.Duration
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type rateLimiter struct {
+	rateLimit
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type rateLimitResult struct {
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration
+	reset      time.Duration
+}
+
+type cachedToken struct {
+	id      int64
+	expires time.Time
+}
+
+// tokenCache remembers which token recently seen API keys belong to, by the hash of the key
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[[sha256.Size]byte]cachedToken
+}
+
+// tokenCacheAge is how long an API key is remembered for, which is also how long a revoked key keeps its bucket
+const tokenCacheAge = time.Minute
+
+var keyLimiter = &rateLimiter{rateLimit: rateLimit{limit: 600, window: time.Minute}, buckets: map[string]*bucket{}}
+var ipLimiter = &rateLimiter{rateLimit: rateLimit{limit: 120, window: time.Minute}, buckets: map[string]*bucket{}}
+
+var rateLimitTokens = &tokenCache{tokens: map[[sha256.Size]byte]cachedToken{}}
+
+// trustedProxies are allowed to report the client's IP in X-Forwarded-For
+var trustedProxies []*net.IPNet
+
+// parseRateLimit reads a limit like "120/1m", with "off" or "0" turning rate limiting off
+func parseRateLimit(s string) (rateLimit, error) {
+	if s == "off" || s == "0" {
+		return rateLimit{}, nil
+	}
+
+	count, window, found := strings.Cut(s, "/")
+	if !found {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q - use requests/duration, e.g. 120/1m", s)
+	}
+
+	limit, err := strconv.Atoi(count)
+	if err != nil || limit < 0 {
+		return rateLimit{}, fmt.Errorf("invalid request count in rate limit %q", s)
+	}
+	duration, err := parseDuration(window)
+	if err != nil || duration <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid duration in rate limit %q", s)
+	}
+
+	return rateLimit{limit: limit, window: duration}, nil
+}
+
+func loadRateLimits() error {
+	for name, limiter := range map[string]*rateLimiter{
+		"EULM_FILES_RATE_LIMIT_KEY": keyLimiter,
+		"EULM_FILES_RATE_LIMIT_IP":  ipLimiter,
+	} {
+		if value := os.Getenv(name); value != "" {
+			limit, err := parseRateLimit(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			limiter.rateLimit = limit
+		}
+	}
+
+	if value := os.Getenv("EULM_FILES_TRUSTED_PROXIES"); value != "" {
+		for _, entry := range strings.Split(value, ",") {
+			entry = strings.TrimSpace(entry)
+			if !strings.Contains(entry, "/") {
+				if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+					entry += "/32"
+				} else {
+					entry += "/128"
+				}
+			}
+
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return fmt.Errorf("EULM_FILES_TRUSTED_PROXIES: invalid address %q", entry)
+			}
+			trustedProxies = append(trustedProxies, network)
+		}
+	}
+
+	return nil
+}
+
+func (l *rateLimiter) enabled() bool {
+	return l.limit > 0
+}
+
+// take uses up one request from the key's bucket if there's one left
+func (l *rateLimiter) take(key string) rateLimitResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	perSecond := float64(l.limit) / l.window.Seconds()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.limit), b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+
+	result := rateLimitResult{allowed: b.tokens >= 1}
+	if result.allowed {
+		b.tokens--
+	} else {
+		result.retryAfter = time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	result.remaining = int(b.tokens)
+	result.reset = time.Duration((float64(l.limit) - b.tokens) / perSecond * float64(time.Second))
+
+	return result
+}
+
+// prune forgets buckets that have refilled completely, since a new bucket would be identical
+func (l *rateLimiter) prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if time.Since(b.updated) >= l.window {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (c *tokenCache) get(apiKey string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	token, ok := c.tokens[sha256.Sum256([]byte(apiKey))]
+	if !ok || time.Now().After(token.expires) {
+		return 0, false
+	}
+	return token.id, true
+}
+
+func (c *tokenCache) set(apiKey string, tokenId int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tokens[sha256.Sum256([]byte(apiKey))] = cachedToken{id: tokenId, expires: time.Now().Add(tokenCacheAge)}
+}
+
+// prune forgets keys that are no longer remembered
+func (c *tokenCache) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for key, token := range c.tokens {
+		if now.After(token.expires) {
+			delete(c.tokens, key)
+		}
+	}
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP finds the IP of the client making a request, following X-Forwarded-For back through trusted proxies
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	// Each proxy appends the address it received the request from, so the client is the last one that isn't trusted
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+
+	return ip.String()
+}
+
+// applyRateLimit uses up a request from a bucket, responding with an error if there are none left
+func applyRateLimit(w http.ResponseWriter, limiter *rateLimiter, key string) bool {
+	result := limiter.take(key)
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limiter.limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.reset.Seconds()))))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limiter.limit, int(limiter.window.Seconds())))
+
+	if !result.allowed {
+		retryAfter := int(math.Ceil(result.retryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		respondJSON(w, http.StatusTooManyRequests, map[string]any{
+			"message":    fmt.Sprintf("Too many requests - try again in %d seconds", retryAfter),
+			"retryAfter": retryAfter,
+		})
+		return false
+	}
+	return true
+}
+
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Probes from orchestrators and load balancers shouldn't use up the limit for their IP
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		apiKey, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		tokenId, known := rateLimitTokens.get(apiKey)
+		if !known {
+			if ipLimiter.enabled() && !applyRateLimit(w, ipLimiter, "ip:"+clientIP(r)) {
+				return
+			}
+
+			// Only keys that exist get their own bucket, so made up keys can't be used to get a fresh one every time
+			if apiKey != "" {
+				if token, _, _, err := findToken(apiKey); err == nil {
+					tokenId, known = token.Id, true
+					rateLimitTokens.set(apiKey, token.Id)
+				}
+			}
+		}
+
+		if known && keyLimiter.enabled() && !applyRateLimit(w, keyLimiter, fmt.Sprintf("token:%d", tokenId)) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Files are searched by name, tags and description. When the SQLite driver is built with FTS5 (go build -tags
+// sqlite_fts5) they're kept in a full-text index by triggers, otherwise searches fall back to slower LIKE matching.
+//
+// The fallback is deliberate: go-sqlite3 only compiles FTS5 in with that build tag, which this module can't turn on
+// by default, and a plain go build shouldn't produce a server that refuses to start. Searches without the index match
+// every term as a substring and list results newest first instead of by relevance
+
+const (
+	maxTags              = 20
+	maxTagLength         = 50
+	maxDescriptionLength = 1000
+	defaultSearchLimit   = 50
+	maxSearchLimit       = 200
+)
+
+// searchIndexed is set when the full-text index is available
+var searchIndexed bool
+
+// parseTags normalises a list of tags, lowercasing them and dropping duplicates
+func parseTags(tags []string) ([]string, error) {
+	parsed := []string{}
+	seen := map[string]bool{}
+
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.Join(strings.Fields(tag), " "))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > maxTagLength || strings.Contains(tag, ",") {
+			return nil, fmt.Errorf("Invalid tag %q - tags can't contain commas or be longer than %d characters", tag, maxTagLength)
+		}
+		seen[tag] = true
+		parsed = append(parsed, tag)
+	}
+
+	if len(parsed) > maxTags {
+		return nil, fmt.Errorf("Files can have at most %d tags", maxTags)
+	}
+	return parsed, nil
+}
+
+func validateDescription(description string) error {
+	if len(description) > maxDescriptionLength {
+		return fmt.Errorf("The description can be at most %d characters", maxDescriptionLength)
+	}
+	return nil
+}
+
+// setFileTags replaces a file's tags
+func setFileTags(fileId string, tags []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("DELETE FROM file_tags WHERE file_id = ?", fileId); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for _, tag := range tags {
+		if _, err = tx.Exec("INSERT INTO file_tags (file_id, tag) VALUES (?, ?)", fileId, tag); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// initSearchIndex creates the full-text index if FTS5 is available. The triggers keeping it up to date are dropped
+// when it isn't, and the index is rebuilt when they're added back, since changes made in between were missed
+func initSearchIndex() error {
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&searchIndexed); err != nil {
+		return err
+	}
+
+	if !searchIndexed {
+		logger.Warn("SQLite was built without FTS5, searches will use slower LIKE matching - build with -tags sqlite_fts5 to use the full-text index")
+		_, err := db.Exec(`
+			DROP TRIGGER IF EXISTS files_fts_insert;
+			DROP TRIGGER IF EXISTS files_fts_update;
+			DROP TRIGGER IF EXISTS files_fts_delete;
+			DROP TRIGGER IF EXISTS file_tags_fts_insert;
+			DROP TRIGGER IF EXISTS file_tags_fts_delete;
+		`)
+		return err
+	}
+
+	var triggers int
+	if err := db.QueryRow(
+		`SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name IN (
+			'files_fts_insert', 'files_fts_update', 'files_fts_delete', 'file_tags_fts_insert', 'file_tags_fts_delete'
+		)`,
+	).Scan(&triggers); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS files_fts USING fts5 (
+			file_id UNINDEXED,
+			name,
+			tags,
+			description,
+			tokenize = 'unicode61 remove_diacritics 2'
+		);
+		CREATE TRIGGER IF NOT EXISTS files_fts_insert AFTER INSERT ON files BEGIN
+			INSERT INTO files_fts (file_id, name, tags, description) VALUES (new.id, new.file_name, '', new.description);
+		END;
+		CREATE TRIGGER IF NOT EXISTS files_fts_update AFTER UPDATE OF file_name, description ON files BEGIN
+			UPDATE files_fts SET name = new.file_name, description = new.description WHERE file_id = new.id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS files_fts_delete AFTER DELETE ON files BEGIN
+			DELETE FROM files_fts WHERE file_id = old.id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS file_tags_fts_insert AFTER INSERT ON file_tags BEGIN
+			UPDATE files_fts SET tags = (SELECT group_concat(tag, ' ') FROM file_tags WHERE file_id = new.file_id)
+			WHERE file_id = new.file_id;
+		END;
+		CREATE TRIGGER IF NOT EXISTS file_tags_fts_delete AFTER DELETE ON file_tags BEGIN
+			UPDATE files_fts SET tags = COALESCE((SELECT group_concat(tag, ' ') FROM file_tags WHERE file_id = old.file_id), '')
+			WHERE file_id = old.file_id;
+		END;
+	`); err != nil {
+		return err
+	}
+
+	if triggers == 5 {
+		return nil
+	}
+
+	logger.Info("Rebuilding search index")
+	_, err := db.Exec(`
+		DELETE FROM files_fts;
+		INSERT INTO files_fts (file_id, name, tags, description)
+		SELECT id, file_name, COALESCE((SELECT group_concat(tag, ' ') FROM file_tags WHERE file_id = files.id), ''), description
+		FROM files;
+	`)
+	return err
+}
+
+// ftsQuery turns what a user typed into an FTS5 query matching files that contain every word, treating each word
+// as a prefix and everything else literally so search syntax can't cause errors
+func ftsQuery(q string) string {
+	terms := strings.Fields(q)
+	for i, term := range terms {
+		terms[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+	}
+	return strings.Join(terms, " ")
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+func handleSearch(r *mux.Router) {
+	r.HandleFunc("/search", validatePerms(ReadWriteSelf, ScopeList, func(w http.ResponseWriter, r *http.Request) {
+		perms, err := getPermissions(r)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Warn("Error parsing permissions header", "error", err)
+			return
+		}
+
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		tag := strings.ToLower(strings.Join(strings.Fields(r.URL.Query().Get("tag")), " "))
+		if q == "" && tag == "" {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "A search query (q) or tag is required"})
+			return
+		}
+
+		limit := defaultSearchLimit
+		if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+			limit, err = strconv.Atoi(limitParam)
+			if err != nil || limit <= 0 || limit > maxSearchLimit {
+				respondJSON(w, http.StatusBadRequest, map[string]any{
+					"message": fmt.Sprintf("limit must be a whole number between 1 and %d", maxSearchLimit),
+				})
+				return
+			}
+		}
+
+		query := "SELECT " + fileColumns + " FROM files"
+		var conditions []string
+		var args []any
+		order := "files.uploaded_at DESC"
+
+		if q != "" && searchIndexed {
+			query += " JOIN files_fts ON files_fts.file_id = files.id"
+			conditions = append(conditions, "files_fts MATCH ?")
+			args = append(args, ftsQuery(q))
+			// Matches in the name count for the most and matches in the description the least
+			order = "bm25(files_fts, 0, 10, 5, 1), " + order
+		} else if q != "" {
+			for _, term := range strings.Fields(q) {
+				pattern := "%" + escapeLike(term) + "%"
+				conditions = append(conditions, `(files.file_name LIKE ? ESCAPE '\' OR files.description LIKE ? ESCAPE '\'
+					OR EXISTS (SELECT 1 FROM file_tags WHERE file_id = files.id AND tag LIKE ? ESCAPE '\'))`)
+				args = append(args, pattern, pattern, pattern)
+			}
+		}
+		if tag != "" {
+			conditions = append(conditions, "EXISTS (SELECT 1 FROM file_tags WHERE file_id = files.id AND tag = ?)")
+			args = append(args, tag)
+		}
+		if perms < ReadWriteAll {
+			conditions = append(conditions, "files.creator = ?")
+			args = append(args, r.Header.Get("username"))
+		}
+
+		query += " WHERE " + strings.Join(conditions, " AND ") + " ORDER BY " + order + " LIMIT ?"
+		args = append(args, limit)
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Warn("Error searching files", "error", err)
+			return
+		}
+		defer func(rows *sql.Rows) {
+			if err = rows.Close(); err != nil {
+				logger.Request(r).Error("Error closing queried rows", "error", err)
+			}
+		}(rows)
+
+		files := []File{}
+		for rows.Next() {
+			file, err := scanFile(rows)
+			if err != nil {
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Warn("Error reading queried row", "error", err)
+				return
+			}
+			files = append(files, file)
+		}
+		if err = rows.Err(); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Warn("Error searching files", "error", err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message": "Search completed successfully",
+			"files":   files,
+		})
+	})).Methods("GET")
+}
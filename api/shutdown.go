@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// On SIGINT or SIGTERM the server stops accepting connections and waits for requests in progress, including uploads
+// and downloads, along with background work like checksums and thumbnails. Anything still running once
+// EULM_FILES_SHUTDOWN_TIMEOUT has passed is cut off and given a moment to clean up before the database is closed.
+// If it still hasn't finished by then, the database is left open rather than closed under it
+
+var shutdownTimeout = 30 * time.Second
+
+// cleanupGrace is how long requests cut off at the deadline get to remove their partial files
+const cleanupGrace = 5 * time.Second
+
+// inFlight tracks requests being handled and background tracks work started outside of them
+var inFlight sync.WaitGroup
+var background sync.WaitGroup
+
+// backgroundClosed is set under backgroundMu once shutdown starts waiting for background work, so none is added after
+var backgroundMu sync.Mutex
+var backgroundClosed bool
+
+func loadShutdownTimeout() error {
+	if value := os.Getenv("EULM_FILES_SHUTDOWN_TIMEOUT"); value != "" {
+		timeout, err := parseDuration(value)
+		if err != nil || timeout < 0 {
+			return fmt.Errorf("EULM_FILES_SHUTDOWN_TIMEOUT: invalid duration %q", value)
+		}
+		shutdownTimeout = timeout
+	}
+	return nil
+}
+
+// trackRequests counts requests in progress so they can be waited for after their connections are closed
+func trackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// runInBackground runs f in a goroutine that shutdown waits for, or skips it if the server is already shutting down
+func runInBackground(f func()) {
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+	if backgroundClosed {
+		logger.Warn("Skipped background work as the server is shutting down")
+		return
+	}
+
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		f()
+	}()
+}
+
+// waitFor waits for wg until the timeout, reporting whether it finished
+func waitFor(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// listen serves requests until the server is shut down
+func listen(server *http.Server, name string) {
+	logger.Info(name+" starting", "addr", server.Addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Fatal("Error starting "+name, "error", err)
+	}
+}
+
+// shutdown stops the servers and waits for requests and background work to finish, up to the shutdown timeout,
+// reporting whether everything finished
+func shutdown(servers ...*http.Server) bool {
+	logger.Info("Shutting down",
+		"timeout", shutdownTimeout.String(),
+		"activeUploads", metrics.activeUploads.Load(),
+		"activeDownloads", metrics.activeDownloads.Load(),
+	)
+
+	deadline := time.Now().Add(shutdownTimeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		if server == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				logger.Warn("Requests still in progress at the shutdown deadline were cut off",
+					"addr", server.Addr,
+					"activeUploads", metrics.activeUploads.Load(),
+					"activeDownloads", metrics.activeDownloads.Load(),
+				)
+				if err = server.Close(); err != nil {
+					logger.Error("Error closing connections", "addr", server.Addr, "error", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	finished := true
+	if !waitFor(&inFlight, cleanupGrace) {
+		logger.Warn("Requests were still running after their connections were closed")
+		finished = false
+	}
+
+	backgroundMu.Lock()
+	backgroundClosed = true
+	backgroundMu.Unlock()
+	if !waitFor(&background, max(time.Until(deadline), cleanupGrace)) {
+		logger.Warn("Background work was still running at the shutdown deadline")
+		finished = false
+	}
+
+	return finished
+}
+
+// removeLeftoverTempFiles deletes partial files from uploads, replacements, restores and thumbnails that were
+// interrupted by the server stopping, leaving tus uploads to be resumed
+func removeLeftoverTempFiles() error {
+	paths, err := filepath.Glob(filepath.Join(partialDir, "*-*.part"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if err = os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if len(paths) > 0 {
+		logger.Info("Removed partial files left by interrupted requests", "count", len(paths))
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Private files can only be downloaded by their owner or through a link signed with the server secret
+// that stops working after a set time
+
+var signingSecret []byte
+
+const signingSecretPath = "db/signing.key"
+const maxShareTTL = 30 * 24 * time.Hour
+
+// loadSigningSecret uses EULM_FILES_SIGNING_SECRET if it's set, otherwise generating a secret the first time the API
+// runs and keeping it in the database directory so signed links survive restarts
+func loadSigningSecret() error {
+	if secret := os.Getenv("EULM_FILES_SIGNING_SECRET"); secret != "" {
+		signingSecret = []byte(secret)
+		return nil
+	}
+
+	secret, err := os.ReadFile(signingSecretPath)
+	if err == nil {
+		signingSecret = secret
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	secret = make([]byte, 32)
+	if _, err = rand.Read(secret); err != nil {
+		return err
+	}
+	if err = os.WriteFile(signingSecretPath, secret, 0600); err != nil {
+		return err
+	}
+
+	signingSecret = secret
+	logger.Info("Generated a new signing secret for private file links")
+	return nil
+}
+
+func signFileLink(fileId string, expires int64) string {
+	mac := hmac.New(sha256.New, signingSecret)
+	mac.Write([]byte(fmt.Sprintf("%s\n%d", fileId, expires)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkSignedLink reports whether a request has an unexpired signature for the file in its query string
+func checkSignedLink(r *http.Request, fileId string) bool {
+	query := r.URL.Query()
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return hmac.Equal([]byte(query.Get("signature")), []byte(signFileLink(fileId, expires)))
+}
+
+// checkOwnerKey reports whether a request has an API key allowed to read the file, which is either the owner's
+// or one with access to all files
+func checkOwnerKey(r *http.Request, creator string) bool {
+	apiKey, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found || apiKey == "" {
+		return false
+	}
+
+	token, user, expired, err := findToken(apiKey)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			logger.Request(r).Error("Error querying permissions from API key", "error", err)
+		}
+		return false
+	}
+	if expired || user.Disabled || token.Scopes&ScopeList == 0 {
+		return false
+	}
+
+	return user.Username == creator || user.Permissions >= ReadWriteAll
+}
+
+// checkPrivateAccess responds with 403 Forbidden unless a request for a private file is signed or from its owner
+func checkPrivateAccess(w http.ResponseWriter, r *http.Request, fileId string, creator string) bool {
+	if checkSignedLink(r, fileId) || checkOwnerKey(r, creator) {
+		w.Header().Set("Cache-Control", "private, no-store")
+		return true
+	}
+
+	respondJSON(w, http.StatusForbidden, map[string]any{"message": "This file is private - use a signed link or the owner's API key"})
+	return false
+}
+
+// requestBaseUrl works out the URL the API was reached through, including behind a reverse proxy
+func requestBaseUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	host := r.Host
+	if forwardedHost := r.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+		host = forwardedHost
+	}
+
+	return scheme + "://" + host
+}
+
+type ShareRequestBody struct {
+	TTL string `json:"ttl"`
+}
+
+func handleShare(r *mux.Router) {
+	r.HandleFunc("/{fileId}/share", validatePerms(ReadWriteSelf, ScopeList, func(w http.ResponseWriter, r *http.Request) {
+		fileId := mux.Vars(r)["fileId"]
+		username := r.Header.Get("username")
+
+		var body ShareRequestBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid JSON body"})
+			return
+		}
+
+		ttl := time.Hour
+		if body.TTL != "" {
+			var err error
+			if ttl, err = parseDuration(body.TTL); err != nil || ttl <= 0 {
+				respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid TTL duration"})
+				return
+			}
+			if ttl > maxShareTTL {
+				respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Links can't last longer than 30 days"})
+				return
+			}
+		}
+
+		perms, err := getPermissions(r)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Warn("Error parsing permissions header", "error", err)
+			return
+		}
+
+		var creator string
+		if err = db.QueryRow("SELECT creator FROM files WHERE id = ?", fileId).Scan(&creator); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				respondJSON(w, http.StatusNotFound, map[string]any{"message": "File not found"})
+				return
+			}
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying file creator from ID", "error", err)
+			return
+		}
+
+		if perms < ReadWriteAll && username != creator {
+			auditDeniedRequest(r, username, "Not the file's owner")
+			respondJSON(w, http.StatusUnauthorized, map[string]any{"message": "Insufficient permissions"})
+			return
+		}
+
+		expiresAt := time.Now().Add(ttl)
+		path := fmt.Sprintf("/%s?expires=%d&signature=%s", fileId, expiresAt.Unix(), signFileLink(fileId, expiresAt.Unix()))
+
+		logger.Request(r).Info("Signed link created")
+		audit(r, "file.share", fileId, "expires "+expiresAt.UTC().Format(time.RFC3339))
+		respondJSON(w, http.StatusCreated, map[string]any{
+			"message":   "Signed link created successfully",
+			"url":       requestBaseUrl(r) + path,
+			"path":      path,
+			"expiresAt": expiresAt.UTC().Format(time.RFC3339),
+		})
+	})).Methods("POST")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCheckSignedLink(t *testing.T) {
+	signingSecret = []byte("test secret")
+
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Second).Unix()
+
+	// The first hex digit is always changed, whatever it was
+	tampered := []byte(signFileLink("abc123", future))
+	if tampered[0] == '0' {
+		tampered[0] = '1'
+	} else {
+		tampered[0] = '0'
+	}
+
+	tests := []struct {
+		name      string
+		fileId    string
+		expires   string
+		signature string
+		want      bool
+	}{
+		{"valid", "abc123", strconv.FormatInt(future, 10), signFileLink("abc123", future), true},
+		{"expired", "abc123", strconv.FormatInt(past, 10), signFileLink("abc123", past), false},
+		{"expiry extended", "abc123", strconv.FormatInt(future+1, 10), signFileLink("abc123", future), false},
+		{"other file", "xyz789", strconv.FormatInt(future, 10), signFileLink("abc123", future), false},
+		{"tampered signature", "abc123", strconv.FormatInt(future, 10), string(tampered), false},
+		{"missing signature", "abc123", strconv.FormatInt(future, 10), "", false},
+		{"missing expiry", "abc123", "", signFileLink("abc123", 0), false},
+		{"invalid expiry", "abc123", "soon", signFileLink("abc123", future), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := url.Values{"expires": {test.expires}, "signature": {test.signature}}
+			req := httptest.NewRequest("GET", "/"+test.fileId+"?"+query.Encode(), nil)
+
+			if got := checkSignedLink(req, test.fileId); got != test.want {
+				t.Errorf("checkSignedLink() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSignFileLinkDependsOnSecret(t *testing.T) {
+	signingSecret = []byte("first secret")
+	first := signFileLink("abc123", 1)
+	signingSecret = []byte("second secret")
+	second := signFileLink("abc123", 1)
+
+	if first == second {
+		t.Error("signatures made with different secrets are the same")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const sweepInterval = time.Minute
+
+// staleUploadAge is how long a tus upload is kept after the last data was sent to it, both to be resumed and
+// to report its file ID once complete
+const staleUploadAge = 24 * time.Hour
+
+// runSweeper periodically deletes expired files, abandoned uploads and old versions past their retention,
+// and forgets idle rate limit buckets and cached API keys, until ctx is cancelled
+func runSweeper(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		sweepExpiredFiles()
+		sweepStaleUploads()
+		if err := pruneVersions(""); err != nil {
+			logger.Error("Error pruning old file versions", "error", err)
+		}
+		keyLimiter.prune()
+		ipLimiter.prune()
+		rateLimitTokens.prune()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func sweepExpiredFiles() {
+	rows, err := db.Query("SELECT id FROM files WHERE expires_at IS NOT NULL AND expires_at <= datetime('now')")
+	if err != nil {
+		logger.Error("Error querying expired files", "error", err)
+		return
+	}
+
+	var fileIds []string
+	for rows.Next() {
+		var fileId string
+		if err = rows.Scan(&fileId); err != nil {
+			logger.Error("Error reading queried row", "error", err)
+			break
+		}
+		fileIds = append(fileIds, fileId)
+	}
+	if err = rows.Close(); err != nil {
+		logger.Error("Error closing queried rows", "error", err)
+	}
+
+	for _, fileId := range fileIds {
+		if err = retireFile(fileId, retiredExpired); err != nil {
+			logger.Error("Error deleting expired file", "fileId", fileId, "error", err)
+			continue
+		}
+		logger.Info("File expired and was deleted", "fileId", fileId)
+		recordAuditEvent(nil, "", "file.delete", fileId, auditSuccess, "Expired")
+	}
+}
+
+func sweepStaleUploads() {
+	cutoff := time.Now().Add(-staleUploadAge).UTC().Format(sqliteTimeFormat)
+
+	rows, err := db.Query("SELECT id, file_id IS NOT NULL FROM uploads WHERE COALESCE(updated_at, created_at) <= ?", cutoff)
+	if err != nil {
+		logger.Error("Error querying stale uploads", "error", err)
+		return
+	}
+
+	uploads := map[string]bool{}
+	for rows.Next() {
+		var uploadId string
+		var complete bool
+		if err = rows.Scan(&uploadId, &complete); err != nil {
+			logger.Error("Error reading queried row", "error", err)
+			break
+		}
+		uploads[uploadId] = complete
+	}
+	if err = rows.Close(); err != nil {
+		logger.Error("Error closing queried rows", "error", err)
+	}
+
+	for uploadId, complete := range uploads {
+		sweepUpload(uploadId, complete)
+	}
+}
+
+func sweepUpload(uploadId string, complete bool) {
+	// Skip uploads that are still receiving data, they'll be caught by a later sweep
+	lock, _ := uploadLocks.LoadOrStore(uploadId, &sync.Mutex{})
+	if !lock.(*sync.Mutex).TryLock() {
+		return
+	}
+	defer lock.(*sync.Mutex).Unlock()
+
+	if !complete {
+		filePath := partialPath(uploadId)
+		if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logger.Error("Error deleting file", "path", filePath, "error", err)
+			return
+		}
+	}
+
+	if _, err := db.Exec("DELETE FROM uploads WHERE id = ?", uploadId); err != nil {
+		logger.Error("Error deleting stale upload", "error", err)
+		return
+	}
+	uploadLocks.Delete(uploadId)
+}
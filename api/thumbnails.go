@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Thumbnails are scaled down so their longest side is one of thumbnailSizes, and kept next to the file's data as
+// db/<id>.thumb-<size>.<jpg|png>. They're made in the background after an upload, or when first requested for
+// files uploaded before thumbnails existed
+
+var thumbnailSizes = []int{128, 256, 512}
+
+const defaultThumbnailSize = 256
+
+// maxThumbnailPixels stops small files that decode to huge images from using up all the server's memory
+const maxThumbnailPixels = 50_000_000
+
+// thumbnailFormats maps the image types thumbnails can be made for to the format they're saved in,
+// keeping PNG for anything that could be transparent
+var thumbnailFormats = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "png",
+}
+
+var errNoThumbnail = errors.New("no thumbnail can be made for this file")
+
+func loadThumbnailSizes() error {
+	value := os.Getenv("EULM_FILES_THUMBNAIL_SIZES")
+	if value == "" {
+		return nil
+	}
+
+	var sizes []int
+	for _, entry := range strings.Split(value, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(entry))
+		if err != nil || size <= 0 || size > 4096 {
+			return fmt.Errorf("invalid thumbnail size %q", entry)
+		}
+		sizes = append(sizes, size)
+	}
+	slices.Sort(sizes)
+
+	thumbnailSizes = slices.Compact(sizes)
+	return nil
+}
+
+func thumbnailFormat(mimeType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return "", false
+	}
+	format, ok := thumbnailFormats[mediaType]
+	return format, ok
+}
+
+// thumbnailURL includes the version of the file's data, so replacing or restoring it changes the URL and caches
+// don't keep showing the old thumbnail
+func thumbnailURL(fileId string, version int) string {
+	return fmt.Sprintf("/%s/thumb?v=%d", fileId, version)
+}
+
+func thumbnailPath(fileId string, size int, format string) string {
+	return fmt.Sprintf("db/%s.thumb-%d.%s", fileId, size, format)
+}
+
+// hasThumbnail reports whether thumbnails are offered for a file. Files with a download limit don't get them,
+// since a thumbnail would show the image without using up a download
+func hasThumbnail(mimeType string, maxDownloads *int) bool {
+	_, ok := thumbnailFormat(mimeType)
+	return ok && maxDownloads == nil
+}
+
+// resizeImage scales an image down so its longest side is maxSize, averaging the pixels that end up in each
+// pixel of the thumbnail. Images that are already small enough are returned as they are
+func resizeImage(src image.Image, maxSize int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSize && height <= maxSize {
+		return src
+	}
+
+	dstWidth, dstHeight := maxSize, max(1, height*maxSize/width)
+	if height > width {
+		dstWidth, dstHeight = max(1, width*maxSize/height), maxSize
+	}
+
+	sums := make([]uint64, dstWidth*dstHeight*4)
+	counts := make([]uint64, dstWidth*dstHeight)
+	for y := 0; y < height; y++ {
+		row := y * dstHeight / height * dstWidth
+		for x := 0; x < width; x++ {
+			i := row + x*dstWidth/width
+			r, g, b, a := src.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			sums[i*4] += uint64(r)
+			sums[i*4+1] += uint64(g)
+			sums[i*4+2] += uint64(b)
+			sums[i*4+3] += uint64(a)
+			counts[i]++
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for i, count := range counts {
+		for c := 0; c < 4; c++ {
+			dst.Pix[i*4+c] = uint8(sums[i*4+c] / count >> 8)
+		}
+	}
+	return dst
+}
+
+func decodeImage(filePath string, mimeType string) (image.Image, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		if err = file.Close(); err != nil {
+			logger.Error("Error closing file", "path", filePath, "error", err)
+		}
+	}(file)
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errNoThumbnail, err.Error())
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return nil, fmt.Errorf("%w: image is %dx%d", errNoThumbnail, config.Width, config.Height)
+	}
+	if _, err = file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	var img image.Image
+	switch mediaType, _, _ := mime.ParseMediaType(mimeType); mediaType {
+	case "image/jpeg":
+		img, err = jpeg.Decode(file)
+	case "image/png":
+		img, err = png.Decode(file)
+	case "image/gif":
+		img, err = gif.Decode(file)
+	default:
+		return nil, errNoThumbnail
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errNoThumbnail, err.Error())
+	}
+	return img, nil
+}
+
+// generateThumbnails makes thumbnails of the given sizes for a file, decoding the original only once
+func generateThumbnails(fileId string, mimeType string, sizes []int) error {
+	format, ok := thumbnailFormat(mimeType)
+	if !ok {
+		return errNoThumbnail
+	}
+
+	img, err := decodeImage(blobPath(fileId), mimeType)
+	if err != nil {
+		return err
+	}
+
+	for _, size := range sizes {
+		// Written to a temporary file first so a thumbnail is never served half written
+		tempFile, err := os.CreateTemp(partialDir, "thumb-*.part")
+		if err != nil {
+			return err
+		}
+		tempPath := tempFile.Name()
+
+		thumbnail := resizeImage(img, size)
+		if format == "jpg" {
+			err = jpeg.Encode(tempFile, thumbnail, &jpeg.Options{Quality: 85})
+		} else {
+			err = png.Encode(tempFile, thumbnail)
+		}
+		if closeErr := tempFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tempPath, thumbnailPath(fileId, size, format))
+		}
+		if err != nil {
+			if removeErr := os.Remove(tempPath); removeErr != nil {
+				logger.Error("Error deleting file", "path", tempPath, "error", removeErr)
+			}
+			return err
+		}
+	}
+
+	// The file may have been deleted while its thumbnails were being made
+	if _, err = os.Stat(blobPath(fileId)); errors.Is(err, os.ErrNotExist) {
+		return removeThumbnails(fileId)
+	}
+	return nil
+}
+
+func removeThumbnails(fileId string) error {
+	paths, err := filepath.Glob(fmt.Sprintf("db/%s.thumb-*", fileId))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if err = os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func handleThumbnails(r *mux.Router) {
+	r.HandleFunc("/{fileId}/thumb", func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		fileId := mux.Vars(r)["fileId"]
+
+		size := defaultThumbnailSize
+		if !slices.Contains(thumbnailSizes, size) {
+			size = thumbnailSizes[0]
+		}
+		if sizeParam := r.URL.Query().Get("size"); sizeParam != "" {
+			size, err = strconv.Atoi(sizeParam)
+			if err != nil || !slices.Contains(thumbnailSizes, size) {
+				sizeNames := make([]string, len(thumbnailSizes))
+				for i, size := range thumbnailSizes {
+					sizeNames[i] = strconv.Itoa(size)
+				}
+				respondJSON(w, http.StatusBadRequest, map[string]any{
+					"message": "Invalid thumbnail size - use one of " + strings.Join(sizeNames, ", "),
+				})
+				return
+			}
+		}
+
+		stored, ok := authorizeDownload(w, r, fileId)
+		if !ok {
+			return
+		}
+
+		if !hasThumbnail(stored.mimeType, stored.maxDownloads) {
+			respondJSON(w, http.StatusNotFound, map[string]any{"message": "No thumbnail is available for this file"})
+			return
+		}
+		format, _ := thumbnailFormat(stored.mimeType)
+
+		filePath := thumbnailPath(fileId, size, format)
+		file, err := os.Open(filePath)
+		if errors.Is(err, os.ErrNotExist) {
+			if err = generateThumbnails(fileId, stored.mimeType, []int{size}); err != nil {
+				if errors.Is(err, errNoThumbnail) {
+					respondJSON(w, http.StatusNotFound, map[string]any{"message": "No thumbnail is available for this file"})
+					logger.Request(r).Warn("Error making thumbnail for file", "error", err)
+					return
+				}
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Error("Error making thumbnail for file", "error", err)
+				return
+			}
+			file, err = os.Open(filePath)
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error opening file", "path", filePath, "error", err)
+			return
+		}
+		defer func(file *os.File) {
+			if err = file.Close(); err != nil {
+				logger.Request(r).Error("Error closing file", "path", filePath, "error", err)
+			}
+		}(file)
+
+		info, err := file.Stat()
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error reading file info", "error", err)
+			return
+		}
+
+		if format == "jpg" {
+			w.Header().Set("Content-Type", "image/jpeg")
+		} else {
+			w.Header().Set("Content-Type", "image/png")
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("ETag", fmt.Sprintf("\"v%d-%d-%s\"", stored.version, size, format))
+		if stored.private || stored.passwordHash != nil {
+			w.Header().Set("Cache-Control", "private, no-cache")
+		} else if r.URL.Query().Get("v") == strconv.Itoa(stored.version) {
+			w.Header().Set("Cache-Control", "public, max-age=86400")
+		} else {
+			// Without the version in the URL, caches have to check the thumbnail is still current before using it
+			w.Header().Set("Cache-Control", "public, no-cache")
+		}
+		http.ServeContent(w, r, "", info.ModTime(), file)
+	}).Methods("GET", "HEAD")
+}
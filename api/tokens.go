@@ -0,0 +1,602 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type Scope int
+
+type Token struct {
+	Id         int64   `json:"id"`
+	Name       string  `json:"name"`
+	Scopes     Scope   `json:"scopes"`
+	KeyPrefix  string  `json:"keyPrefix"`
+	CreatedAt  string  `json:"createdAt"`
+	ExpiresAt  *string `json:"expiresAt"`
+	LastUsedAt *string `json:"lastUsedAt"`
+}
+
+type CreateTokenRequestBody struct {
+	Name      string `json:"name"`
+	Scopes    Scope  `json:"scopes"`
+	ExpiresIn string `json:"expiresIn"`
+}
+
+type keyHash struct {
+	prefix string
+	salt   string
+	hash   string
+}
+
+const (
+	ScopeUpload Scope = 1 << iota
+	ScopeList
+	ScopeDelete
+	ScopeTokens
+	ScopeAdmin
+	ScopeModify
+
+	NoScopes  Scope = 0
+	AllScopes       = ScopeUpload | ScopeList | ScopeDelete | ScopeTokens | ScopeAdmin | ScopeModify
+)
+
+// legacyAllScopes is every scope that existed before ScopeModify, which tokens from older versions with all of them are given
+const legacyAllScopes = ScopeUpload | ScopeList | ScopeDelete | ScopeTokens | ScopeAdmin
+
+var scopeNames = []struct {
+	scope Scope
+	name  string
+}{
+	{ScopeUpload, "upload"},
+	{ScopeList, "list"},
+	{ScopeDelete, "delete"},
+	{ScopeTokens, "tokens"},
+	{ScopeAdmin, "admin"},
+	{ScopeModify, "modify"},
+}
+
+// masterTokenName is the name of the token created from EULM_FILES_MASTER_KEY, which is replaced whenever the key changes
+const masterTokenName = "master"
+
+// keyPrefixLength is the number of hex characters of an API key's unsalted hash stored so keys can be looked up.
+// Older versions stored the key's own leading characters instead, which are cleared on startup and replaced with
+// the hashed prefix the next time the key is used
+const keyPrefixLength = 8
+
+func (s Scope) MarshalJSON() ([]byte, error) {
+	names := []string{}
+	for _, scope := range scopeNames {
+		if s&scope.scope != 0 {
+			names = append(names, scope.name)
+		}
+	}
+	return json.Marshal(names)
+}
+
+func (s *Scope) UnmarshalJSON(data []byte) error {
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return err
+	}
+
+	*s = NoScopes
+	for _, name := range names {
+		found := false
+		for _, scope := range scopeNames {
+			if scope.name == name {
+				*s |= scope.scope
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown scope %q", name)
+		}
+	}
+
+	return nil
+}
+
+func newApiKey() (string, error) {
+	charset := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
+
+	result := make([]byte, 40)
+	for i := range result {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		if err != nil {
+			return "", err
+		}
+		result[i] = charset[n.Int64()]
+	}
+
+	return string(result), nil
+}
+
+// keyPrefix identifies the tokens a generated API key could belong to without revealing any of the key
+func keyPrefix(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])[:keyPrefixLength]
+}
+
+// legacyKeyPrefixTag marks the prefixes of tokens from older versions, which stored the leading characters of keys
+const legacyKeyPrefixTag = "legacy:"
+
+// legacyKeyPrefix identifies tokens from older versions, for which only the leading characters of the key are known
+func legacyKeyPrefix(apiKey string) string {
+	if len(apiKey) > keyPrefixLength {
+		apiKey = apiKey[:keyPrefixLength]
+	}
+	return legacyKeyPrefixTag + keyPrefix(apiKey)
+}
+
+// hashApiKey uses a plain salted SHA-256 rather than a slow KDF since it runs on every request,
+// and generated keys already have far more entropy than a password. The Master key is chosen by a person,
+// which is why it has to be at least minMasterKeyLength characters long
+func hashApiKey(apiKey string, salt string) string {
+	sum := sha256.Sum256([]byte(salt + apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+func newKeyHash(apiKey string) (keyHash, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return keyHash{}, err
+	}
+	saltStr := hex.EncodeToString(salt)
+
+	return keyHash{
+		prefix: keyPrefix(apiKey),
+		salt:   saltStr,
+		hash:   hashApiKey(apiKey, saltStr),
+	}, nil
+}
+
+// queryRower is either the database or a transaction, so tokens can be created along with other changes
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// insertToken stores the hash of an existing API key as a new token for the user
+func insertToken(q queryRower, username string, name string, apiKey string, scopes Scope, expiresAt *time.Time) (Token, error) {
+	hashed, err := newKeyHash(apiKey)
+	if err != nil {
+		return Token{}, err
+	}
+
+	var expires *string
+	if expiresAt != nil {
+		formatted := expiresAt.UTC().Format(sqliteTimeFormat)
+		expires = &formatted
+	}
+
+	var token Token
+	if err = q.QueryRow(`
+		INSERT INTO tokens (username, name, scopes, key_prefix, key_salt, key_hash, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, datetime('now'), ?)
+		RETURNING id, name, scopes, key_prefix, created_at, expires_at, last_used_at
+	`, username, name, scopes, hashed.prefix, hashed.salt, hashed.hash, expires).Scan(
+		&token.Id, &token.Name, &token.Scopes, &token.KeyPrefix, &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt,
+	); err != nil {
+		return Token{}, err
+	}
+
+	return token, nil
+}
+
+// createToken generates a new API key for the user, returning the key itself as it can't be recovered from the database
+func createToken(q queryRower, username string, name string, scopes Scope, expiresAt *time.Time) (Token, string, error) {
+	apiKey, err := newApiKey()
+	if err != nil {
+		return Token{}, "", err
+	}
+
+	token, err := insertToken(q, username, name, apiKey, scopes, expiresAt)
+	if err != nil {
+		return Token{}, "", err
+	}
+
+	return token, apiKey, nil
+}
+
+// syncMasterToken stores the hash of EULM_FILES_MASTER_KEY as the Master token, replacing it if the key has changed
+func syncMasterToken() error {
+	token, user, _, err := findToken(masterKey)
+	if err == nil && user.Username == masterUsername && token.Name == masterTokenName {
+		_, err = db.Exec("UPDATE tokens SET scopes = ?, expires_at = NULL WHERE id = ?", AllScopes, token.Id)
+		return err
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if _, err = db.Exec("DELETE FROM tokens WHERE username = ? AND name = ?", masterUsername, masterTokenName); err != nil {
+		return err
+	}
+	_, err = insertToken(db, masterUsername, masterTokenName, masterKey, AllScopes, nil)
+	return err
+}
+
+// findToken returns sql.ErrNoRows if no token has the given key
+func findToken(apiKey string) (Token, User, bool, error) {
+	if apiKey == "" {
+		return Token{}, User{}, false, sql.ErrNoRows
+	}
+
+	rows, err := db.Query(`
+		SELECT t.id, t.name, t.scopes, t.key_prefix, t.key_salt, t.key_hash,
+		       t.expires_at IS NOT NULL AND t.expires_at <= datetime('now'),
+		       u.username, u.permissions, u.disabled
+		FROM tokens t JOIN users u ON u.username = t.username
+		WHERE t.key_prefix IN (?, ?)
+	`, keyPrefix(apiKey), legacyKeyPrefix(apiKey))
+	if err != nil {
+		return Token{}, User{}, false, err
+	}
+	defer func(rows *sql.Rows) {
+		if err = rows.Close(); err != nil {
+			logger.Error("Error closing queried rows", "error", err)
+		}
+	}(rows)
+
+	// Prefixes aren't unique, so every token sharing one has to be checked
+	for rows.Next() {
+		var token Token
+		var user User
+		var salt, hash string
+		var expired bool
+		if err = rows.Scan(
+			&token.Id, &token.Name, &token.Scopes, &token.KeyPrefix, &salt, &hash, &expired,
+			&user.Username, &user.Permissions, &user.Disabled,
+		); err != nil {
+			return Token{}, User{}, false, err
+		}
+		if subtle.ConstantTimeCompare([]byte(hashApiKey(apiKey, salt)), []byte(hash)) == 1 {
+			return token, user, expired, nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return Token{}, User{}, false, err
+	}
+
+	return Token{}, User{}, false, sql.ErrNoRows
+}
+
+// keyPrefixesVersion is the database user_version from which tokens no longer have plaintext key prefixes
+const keyPrefixesVersion = 2
+
+// hashedKeyPrefixPattern matches the prefixes keyPrefix returns
+var hashedKeyPrefixPattern = regexp.MustCompile(fmt.Sprintf("^[0-9a-f]{%d}$", keyPrefixLength))
+
+// migrateUserKeys moves the single key older versions stored on each user into a token with every scope, and hashes
+// the leading characters of keys older versions stored to look tokens up. Keys stored in plaintext get the same
+// prefix as new ones, but the rest only have their leading characters to go on, so they get a legacyKeyPrefix
+func migrateUserKeys() error {
+	if err := runMigration(keyPrefixesVersion, func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT id, key_prefix FROM tokens")
+		if err != nil {
+			return err
+		}
+		prefixes := map[int64]string{}
+		for rows.Next() {
+			var id int64
+			var prefix string
+			if err = rows.Scan(&id, &prefix); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			// A leading part of a key that happens to look like a hashed prefix can't be told apart from one
+			if !hashedKeyPrefixPattern.MatchString(prefix) && !strings.HasPrefix(prefix, legacyKeyPrefixTag) {
+				prefixes[id] = prefix
+			}
+		}
+		if err = rows.Close(); err != nil {
+			return err
+		}
+
+		for id, prefix := range prefixes {
+			if _, err = tx.Exec("UPDATE tokens SET key_prefix = ? WHERE id = ?", legacyKeyPrefix(prefix), id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	plaintext, err := hasColumn("users", "api_key")
+	if err != nil {
+		return err
+	}
+	hashed, err := hasColumn("users", "key_hash")
+	if err != nil {
+		return err
+	}
+	if !plaintext && !hashed {
+		return nil
+	}
+
+	var rows *sql.Rows
+	if plaintext {
+		rows, err = db.Query("SELECT username, api_key, '', '' FROM users")
+	} else {
+		rows, err = db.Query("SELECT username, key_prefix, key_salt, key_hash FROM users")
+	}
+	if err != nil {
+		return err
+	}
+
+	var keys [][4]string
+	for rows.Next() {
+		var key [4]string
+		if err = rows.Scan(&key[0], &key[1], &key[2], &key[3]); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if key[0] == masterUsername {
+			continue
+		}
+
+		if plaintext {
+			_, err = insertToken(db, key[0], "default", key[1], AllScopes, nil)
+		} else {
+			_, err = db.Exec(`
+				INSERT INTO tokens (username, name, scopes, key_prefix, key_salt, key_hash, created_at)
+				VALUES (?, 'default', ?, ?, ?, ?, datetime('now'))
+			`, key[0], AllScopes, legacyKeyPrefix(key[1]), key[2], key[3])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err = db.Exec("DROP INDEX IF EXISTS users_key_prefix"); err != nil {
+		return err
+	}
+	for _, column := range []string{"api_key", "key_prefix", "key_salt", "key_hash"} {
+		if exists, err := hasColumn("users", column); err != nil {
+			return err
+		} else if exists {
+			if _, err = db.Exec(fmt.Sprintf("ALTER TABLE users DROP COLUMN %s", column)); err != nil {
+				return err
+			}
+		}
+	}
+
+	logger.Info("Moved API keys to tokens", "count", len(keys))
+	return nil
+}
+
+// tokenScopesVersion is the database user_version from which tokens from older versions have been given ScopeModify
+const tokenScopesVersion = 1
+
+// migrateTokenScopes gives ScopeModify to tokens from before it existed that had every scope, as those could already
+// change files. Tokens with fewer scopes are left alone so upload-only tokens can't start changing existing files
+func migrateTokenScopes() error {
+	return runMigration(tokenScopesVersion, func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE tokens SET scopes = ? WHERE scopes = ?", AllScopes, legacyAllScopes)
+		return err
+	})
+}
+
+func getScopes(r *http.Request) (Scope, error) {
+	scopes, err := strconv.Atoi(r.Header.Get("scopes"))
+	if err != nil {
+		return NoScopes, err
+	}
+	return Scope(scopes), nil
+}
+
+func handleTokens(r *mux.Router) {
+	r.HandleFunc("/tokens", validatePerms(NoPerms, ScopeTokens, func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get("username")
+		currentId := r.Header.Get("tokenId")
+
+		rows, err := db.Query(
+			"SELECT id, name, scopes, key_prefix, created_at, expires_at, last_used_at FROM tokens WHERE username = ? ORDER BY id",
+			username,
+		)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Warn("Error querying tokens", "error", err)
+			return
+		}
+		defer func(rows *sql.Rows) {
+			if err = rows.Close(); err != nil {
+				logger.Request(r).Error("Error closing queried rows", "error", err)
+			}
+		}(rows)
+
+		type listedToken struct {
+			Token
+			Current bool `json:"current"`
+		}
+
+		tokens := []listedToken{}
+		for rows.Next() {
+			var token listedToken
+			if err = rows.Scan(
+				&token.Id, &token.Name, &token.Scopes, &token.KeyPrefix, &token.CreatedAt, &token.ExpiresAt, &token.LastUsedAt,
+			); err != nil {
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Warn("Error reading queried row", "error", err)
+				return
+			}
+			token.Current = strconv.FormatInt(token.Id, 10) == currentId
+			tokens = append(tokens, token)
+		}
+
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message": "Tokens fetched successfully",
+			"tokens":  tokens,
+		})
+	})).Methods("GET")
+
+	r.HandleFunc("/tokens", validatePerms(NoPerms, ScopeTokens, func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get("username")
+
+		var body CreateTokenRequestBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid JSON body"})
+			return
+		}
+
+		if body.Name == "" || len(body.Name) > 64 {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Token names must be between 1 and 64 characters"})
+			return
+		}
+		if body.Scopes == NoScopes {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "At least one scope is required"})
+			return
+		}
+
+		scopes, err := getScopes(r)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Warn("Error parsing scopes header", "error", err)
+			return
+		}
+		if body.Scopes&^scopes != 0 {
+			respondJSON(w, http.StatusForbidden, map[string]any{"message": "Tokens can't have scopes the current token doesn't have"})
+			return
+		}
+
+		var expiresAt *time.Time
+		if body.ExpiresIn != "" {
+			duration, err := parseDuration(body.ExpiresIn)
+			if err != nil || duration <= 0 {
+				respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid expiry duration"})
+				return
+			}
+			expires := time.Now().Add(duration)
+			expiresAt = &expires
+		}
+
+		// Tokens can't outlive the token creating them, so ones without an expiry get the current token's
+		var currentExpiry *string
+		if err = db.QueryRow("SELECT expires_at FROM tokens WHERE id = ?", r.Header.Get("tokenId")).Scan(&currentExpiry); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying token expiry", "error", err)
+			return
+		}
+		if currentExpiry != nil {
+			currentExpiresAt, err := time.Parse(sqliteTimeFormat, *currentExpiry)
+			if err != nil {
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Error("Error parsing token expiry", "error", err)
+				return
+			}
+			if expiresAt == nil {
+				expiresAt = &currentExpiresAt
+			} else if expiresAt.After(currentExpiresAt) {
+				respondJSON(w, http.StatusForbidden, map[string]any{"message": "Tokens can't expire after the current token"})
+				return
+			}
+		}
+
+		token, apiKey, err := createToken(db, username, body.Name, body.Scopes, expiresAt)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error creating token", "error", err)
+			return
+		}
+
+		logger.Request(r).Info("Token created", "tokenId", token.Id)
+		audit(r, "token.create", strconv.FormatInt(token.Id, 10), token.Name)
+		respondJSON(w, http.StatusCreated, map[string]any{
+			"message": "Token created successfully",
+			"token":   token,
+			"apiKey":  apiKey,
+		})
+	})).Methods("POST")
+
+	r.HandleFunc("/tokens/{tokenId}", validatePerms(NoPerms, ScopeTokens, func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get("username")
+		tokenId := mux.Vars(r)["tokenId"]
+
+		var name string
+		if err := db.QueryRow("SELECT name FROM tokens WHERE id = ? AND username = ?", tokenId, username).Scan(&name); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				respondJSON(w, http.StatusNotFound, map[string]any{"message": "Token not found"})
+				return
+			}
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying token from ID", "error", err)
+			return
+		}
+
+		if username == masterUsername && name == masterTokenName {
+			respondJSON(w, http.StatusForbidden, map[string]any{"message": "The Master key is set through EULM_FILES_MASTER_KEY"})
+			return
+		}
+
+		if _, err := db.Exec("DELETE FROM tokens WHERE id = ?", tokenId); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error deleting token", "error", err)
+			return
+		}
+
+		logger.Request(r).Info("Token revoked")
+		audit(r, "token.revoke", tokenId, name)
+		respondJSON(w, http.StatusOK, map[string]any{"message": "Token revoked successfully"})
+	})).Methods("DELETE")
+
+	r.HandleFunc("/keys/rotate", validatePerms(NoPerms, NoScopes, func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get("username")
+		tokenId := r.Header.Get("tokenId")
+
+		if username == masterUsername && r.Header.Get("tokenName") == masterTokenName {
+			respondJSON(w, http.StatusForbidden, map[string]any{"message": "The Master key is set through EULM_FILES_MASTER_KEY"})
+			return
+		}
+
+		apiKey, err := newApiKey()
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error generating API key", "error", err)
+			return
+		}
+
+		hashed, err := newKeyHash(apiKey)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error hashing API key", "error", err)
+			return
+		}
+
+		if _, err = db.Exec(
+			"UPDATE tokens SET key_prefix = ?, key_salt = ?, key_hash = ? WHERE id = ?",
+			hashed.prefix, hashed.salt, hashed.hash, tokenId,
+		); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error updating API key", "error", err)
+			return
+		}
+
+		logger.Request(r).Info("Token rotated", "tokenId", tokenId)
+		audit(r, "token.rotate", tokenId, r.Header.Get("tokenName"))
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message": "API key rotated successfully",
+			"apiKey":  apiKey,
+		})
+	})).Methods("POST")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestFindToken(t *testing.T) {
+	setupTestDB(t)
+	apiKey := addTestUser(t, "alice", ReadWriteSelf, ScopeUpload|ScopeList)
+
+	token, user, expired, err := findToken(apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" || token.Scopes != ScopeUpload|ScopeList || expired {
+		t.Errorf("findToken() = %+v, %+v, %v", token, user, expired)
+	}
+	if token.KeyPrefix != keyPrefix(apiKey) || strings.HasPrefix(apiKey, token.KeyPrefix) {
+		t.Errorf("key prefix %q isn't the hashed prefix %q", token.KeyPrefix, keyPrefix(apiKey))
+	}
+
+	for _, wrongKey := range []string{"", apiKey[:len(apiKey)-1], apiKey + "x", strings.ToUpper(apiKey)} {
+		if _, _, _, err = findToken(wrongKey); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("findToken(%q) error = %v, want sql.ErrNoRows", wrongKey, err)
+		}
+	}
+}
+
+func TestFindTokenSharedPrefix(t *testing.T) {
+	setupTestDB(t)
+	apiKey := addTestUser(t, "alice", ReadWriteSelf, ScopeUpload)
+
+	// Another token with the same prefix but a different key mustn't be matched
+	other, err := newKeyHash("another key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(
+		`INSERT INTO tokens (username, name, scopes, key_prefix, key_salt, key_hash, created_at)
+		VALUES ('alice', 'other', ?, ?, ?, ?, datetime('now'))`,
+		AllScopes, keyPrefix(apiKey), other.salt, other.hash,
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, _, err := findToken(apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Name != "test" || token.Scopes != ScopeUpload {
+		t.Errorf("findToken() matched token %q with scopes %v", token.Name, token.Scopes)
+	}
+}
+
+func TestFindTokenLegacyPrefix(t *testing.T) {
+	setupTestDB(t)
+	apiKey := addTestUser(t, "alice", ReadWriteSelf, ScopeUpload)
+
+	// Older versions stored the leading characters of keys, which the migration hashes
+	if _, err := db.Exec("UPDATE tokens SET key_prefix = ? WHERE username = 'alice'", apiKey[:keyPrefixLength]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", keyPrefixesVersion-1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUserKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, _, err := findToken(apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.KeyPrefix != legacyKeyPrefix(apiKey) || strings.Contains(token.KeyPrefix, apiKey[:keyPrefixLength]) {
+		t.Errorf("key prefix = %q, want %q", token.KeyPrefix, legacyKeyPrefix(apiKey))
+	}
+
+	// Tokens with hashed prefixes are left alone
+	var prefix string
+	if err = db.QueryRow("SELECT key_prefix FROM tokens WHERE username = ?", masterUsername).Scan(&prefix); err != nil {
+		t.Fatal(err)
+	}
+	if prefix != keyPrefix(testMasterKey) {
+		t.Errorf("Master key prefix = %q, want %q", prefix, keyPrefix(testMasterKey))
+	}
+}
+
+func TestFindTokenExpired(t *testing.T) {
+	setupTestDB(t)
+	if _, err := db.Exec("INSERT INTO users (username, permissions) VALUES ('alice', ?)", ReadWriteSelf); err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(-time.Minute)
+	_, apiKey, err := createToken(db, "alice", "old", AllScopes, &expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, expired, err := findToken(apiKey); err != nil || !expired {
+		t.Errorf("findToken() expired = %v, error = %v, want expired", expired, err)
+	}
+}
+
+func TestSyncMasterToken(t *testing.T) {
+	setupTestDB(t)
+
+	token, user, _, err := findToken(testMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != masterUsername || token.Name != masterTokenName || token.Scopes != AllScopes {
+		t.Errorf("findToken(master key) = %+v, %+v", token, user)
+	}
+
+	// The token is kept while the key stays the same
+	if err = syncMasterToken(); err != nil {
+		t.Fatal(err)
+	}
+	if kept, _, _, err := findToken(testMasterKey); err != nil || kept.Id != token.Id {
+		t.Errorf("findToken(master key) = %+v, %v after restarting, want token %d", kept, err, token.Id)
+	}
+
+	masterKey = testMasterKey + " changed"
+	if err = syncMasterToken(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err = findToken(testMasterKey); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("findToken(old master key) error = %v, want sql.ErrNoRows", err)
+	}
+	if _, _, _, err = findToken(masterKey); err != nil {
+		t.Errorf("findToken(new master key) error = %v", err)
+	}
+}
+
+func TestScopeJSON(t *testing.T) {
+	var scopes Scope
+	if err := scopes.UnmarshalJSON([]byte(`["upload","modify"]`)); err != nil {
+		t.Fatal(err)
+	}
+	if scopes != ScopeUpload|ScopeModify {
+		t.Errorf("scopes = %v, want upload and modify", scopes)
+	}
+
+	data, err := scopes.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `["upload","modify"]` {
+		t.Errorf("MarshalJSON() = %s", data)
+	}
+
+	if err = scopes.UnmarshalJSON([]byte(`["upload","everything"]`)); err == nil {
+		t.Error("UnmarshalJSON() accepted an unknown scope")
+	}
+}
+
+func TestCreateTokenExpiry(t *testing.T) {
+	setupTestDB(t)
+	if _, err := db.Exec("INSERT INTO users (username, permissions) VALUES ('alice', ?)", ReadWriteSelf); err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Now().Add(time.Hour)
+	parent, apiKey, err := createToken(db, "alice", "parent", AllScopes, &expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	router := mux.NewRouter()
+	handleTokens(router)
+
+	tests := []struct {
+		name      string
+		expiresIn string
+		want      int
+	}{
+		{"no expiry", "", http.StatusCreated},
+		{"sooner", "30m", http.StatusCreated},
+		{"later", "2h", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"name":%q,"scopes":["upload"],"expiresIn":%q}`, test.name, test.expiresIn)
+			req := httptest.NewRequest("POST", "/tokens", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+
+			if res.Code != test.want {
+				t.Fatalf("status = %d, want %d: %s", res.Code, test.want, res.Body)
+			}
+		})
+	}
+
+	var childExpiry *string
+	if err = db.QueryRow("SELECT expires_at FROM tokens WHERE name = 'no expiry'").Scan(&childExpiry); err != nil {
+		t.Fatal(err)
+	}
+	if childExpiry == nil || *childExpiry != *parent.ExpiresAt {
+		t.Errorf("token without an expiry expires at %v, want %s", childExpiry, *parent.ExpiresAt)
+	}
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Implements the core tus 1.0 protocol (https://tus.io/protocols/resumable-upload) with the creation and
+// termination extensions, as an alternative to /upload for large files and unreliable connections
+
+type tusUpload struct {
+	id       string
+	username string
+	fileName string
+	length   int64
+	metadata string
+	options  string
+	fileId   *string
+}
+
+const tusVersion = "1.0.0"
+
+// uploadLocks stops concurrent PATCH requests from appending to the same upload at once
+var uploadLocks sync.Map
+
+func newUploadId() (string, error) {
+	result := make([]byte, 16)
+	if _, err := rand.Read(result); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(result), nil
+}
+
+func partialPath(uploadId string) string {
+	return filepath.Join(partialDir, uploadId+".part")
+}
+
+// parseTusMetadata decodes an Upload-Metadata header, a comma-separated list of keys and base64 values
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata value for %q: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+// withoutPassword removes the password from an Upload-Metadata header, so it isn't stored or sent back with the
+// rest of the metadata
+func withoutPassword(header string) string {
+	var pairs []string
+	for _, pair := range strings.Split(header, ",") {
+		if key, _, _ := strings.Cut(strings.TrimSpace(pair), " "); key != "password" {
+			pairs = append(pairs, pair)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+func tusHandler(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+
+		if r.Method != "OPTIONS" && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			respondJSON(w, http.StatusPreconditionFailed, map[string]any{"message": "Unsupported tus version"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// getTusUpload loads the upload in the request URL, responding with an error if it doesn't exist or isn't the user's
+func getTusUpload(w http.ResponseWriter, r *http.Request) (tusUpload, bool) {
+	upload := tusUpload{id: mux.Vars(r)["uploadId"]}
+
+	if err := db.QueryRow(
+		"SELECT username, file_name, length, metadata, options, file_id FROM uploads WHERE id = ?", upload.id,
+	).Scan(&upload.username, &upload.fileName, &upload.length, &upload.metadata, &upload.options, &upload.fileId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondJSON(w, http.StatusNotFound, map[string]any{"message": "Upload not found"})
+			return tusUpload{}, false
+		}
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Request(r).Error("Error querying upload from ID", "error", err)
+		return tusUpload{}, false
+	}
+
+	if upload.username != r.Header.Get("username") {
+		respondJSON(w, http.StatusNotFound, map[string]any{"message": "Upload not found"})
+		return tusUpload{}, false
+	}
+
+	return upload, true
+}
+
+// offset returns how many bytes of the upload have been received so far
+func (u tusUpload) offset() (int64, error) {
+	if u.fileId != nil {
+		return u.length, nil
+	}
+
+	info, err := os.Stat(partialPath(u.id))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// tusMaxSize finds the upload limit for the caller of an OPTIONS request, which isn't required to be authenticated.
+// Limits depend on the user, so nothing is reported without a valid API key
+func tusMaxSize(r *http.Request) (int64, bool) {
+	apiKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if apiKey == "" {
+		return 0, false
+	}
+
+	_, user, expired, err := findToken(apiKey)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			logger.Request(r).Error("Error querying permissions from API key", "error", err)
+		}
+		return 0, false
+	}
+	if expired || user.Disabled {
+		return 0, false
+	}
+
+	maxUploadSize, err := maxUploadSizeFor(user.Username, user.Permissions)
+	if err != nil {
+		logger.Request(r).Error("Error querying upload limit", "error", err)
+		return 0, false
+	}
+	return maxUploadSize, true
+}
+
+// deleteTusUpload forgets an upload whose data is already gone, along with its lock
+func deleteTusUpload(uploadId string) error {
+	uploadLocks.Delete(uploadId)
+	_, err := db.Exec("DELETE FROM uploads WHERE id = ?", uploadId)
+	return err
+}
+
+func handleTus(r *mux.Router) {
+	r.HandleFunc("/tus", tusHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		if maxUploadSize, ok := tusMaxSize(r); ok {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})).Methods("OPTIONS")
+
+	r.HandleFunc("/tus", tusHandler(validatePerms(ReadWriteSelf, ScopeUpload, func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get("username")
+
+		if r.Header.Get("Upload-Defer-Length") != "" {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Deferred upload lengths aren't supported"})
+			return
+		}
+
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid Upload-Length header"})
+			return
+		}
+		maxUploadSize, err := requestMaxUploadSize(r)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying upload limit", "error", err)
+			return
+		}
+		if length > maxUploadSize {
+			respondTooLarge(w, maxUploadSize)
+			return
+		}
+
+		if ok, err := checkQuota(username, length); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error checking storage quota", "error", err)
+			return
+		} else if !ok {
+			respondQuotaExceeded(w, username, true)
+			return
+		}
+
+		metadataHeader := r.Header.Get("Upload-Metadata")
+		metadata, err := parseTusMetadata(metadataHeader)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid Upload-Metadata header"})
+			return
+		}
+		if metadata["filename"] == "" {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "The filename metadata value is required"})
+			return
+		}
+		if err = validateFileName(metadata["filename"]); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": err.Error()})
+			return
+		}
+
+		// Options are resolved now rather than on completion, so they're validated before any data is sent
+		options, err := parseUploadOptions(func(key string) string { return metadata[key] })
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": err.Error()})
+			return
+		}
+		if options.Collection != "" && !authorizeCollection(w, r, options.Collection) {
+			return
+		}
+		optionsJSON, err := json.Marshal(options)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error encoding upload options", "error", err)
+			return
+		}
+
+		uploadId, err := newUploadId()
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error generating upload ID", "error", err)
+			return
+		}
+
+		filePath := partialPath(uploadId)
+		file, err := os.Create(filePath)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error creating file", "path", filePath, "error", err)
+			return
+		}
+		if err = file.Close(); err != nil {
+			logger.Request(r).Error("Error closing file", "path", filePath, "error", err)
+		}
+
+		if _, err = db.Exec(
+			"INSERT INTO uploads (id, username, file_name, length, metadata, options, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, datetime('now'), datetime('now'))",
+			uploadId, username, metadata["filename"], length, withoutPassword(metadataHeader), string(optionsJSON),
+		); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error inserting upload into database", "error", err)
+			if err = os.Remove(filePath); err != nil {
+				logger.Request(r).Error("Error deleting file", "path", filePath, "error", err)
+			}
+			return
+		}
+
+		w.Header().Set("Location", "/tus/"+uploadId)
+		respondJSON(w, http.StatusCreated, map[string]any{
+			"message": "Upload created successfully",
+			"id":      uploadId,
+		})
+	}))).Methods("POST")
+
+	r.HandleFunc("/tus/{uploadId}", tusHandler(validatePerms(ReadWriteSelf, ScopeUpload, func(w http.ResponseWriter, r *http.Request) {
+		upload, ok := getTusUpload(w, r)
+		if !ok {
+			return
+		}
+
+		offset, err := upload.offset()
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error reading upload offset", "error", err)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.length, 10))
+		if metadata := withoutPassword(upload.metadata); metadata != "" {
+			w.Header().Set("Upload-Metadata", metadata)
+		}
+		if upload.fileId != nil {
+			w.Header().Set("Eulm-File-Id", *upload.fileId)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))).Methods("HEAD")
+
+	r.HandleFunc("/tus/{uploadId}", tusHandler(validatePerms(ReadWriteSelf, ScopeUpload, func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get("username")
+
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			respondJSON(w, http.StatusUnsupportedMediaType, map[string]any{"message": "Content-Type must be application/offset+octet-stream"})
+			return
+		}
+
+		lock, _ := uploadLocks.LoadOrStore(mux.Vars(r)["uploadId"], &sync.Mutex{})
+		if !lock.(*sync.Mutex).TryLock() {
+			respondJSON(w, http.StatusConflict, map[string]any{"message": "Upload is already in progress"})
+			return
+		}
+		defer lock.(*sync.Mutex).Unlock()
+
+		upload, ok := getTusUpload(w, r)
+		if !ok {
+			// Locks for uploads that don't exist would otherwise pile up
+			uploadLocks.Delete(mux.Vars(r)["uploadId"])
+			return
+		}
+
+		offset, err := upload.offset()
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error reading upload offset", "error", err)
+			return
+		}
+
+		if requestOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64); err != nil || requestOffset != offset {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			respondJSON(w, http.StatusConflict, map[string]any{"message": "Upload-Offset doesn't match the current offset"})
+			return
+		}
+
+		if upload.fileId == nil {
+			filePath := partialPath(upload.id)
+			file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Error("Error opening file", "path", filePath, "error", err)
+				return
+			}
+
+			// Whatever arrives before an error is kept, so the client can resume from there
+			written, err := io.Copy(file, io.LimitReader(r.Body, upload.length-offset))
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			offset += written
+
+			// Uploads are swept once they've been idle for a while, so slow uploads that keep resuming are kept
+			if _, updateErr := db.Exec("UPDATE uploads SET updated_at = datetime('now') WHERE id = ?", upload.id); updateErr != nil {
+				logger.Request(r).Error("Error updating upload activity time", "error", updateErr)
+			}
+
+			if err != nil {
+				w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+				respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Error reading upload data"})
+				logger.Request(r).Warn("Upload interrupted", "uploadId", upload.id, "offset", offset, "error", err)
+				return
+			}
+
+			if offset == upload.length {
+				var options UploadOptions
+				if err = json.Unmarshal([]byte(upload.options), &options); err != nil {
+					respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+					logger.Request(r).Error("Error decoding upload options", "error", err)
+					return
+				}
+
+				fileId, err := storeFile(filePath, upload.fileName, username, options)
+				if err != nil {
+					// storeFile deletes the data when it fails, so the upload can't be resumed either
+					if deleteErr := deleteTusUpload(upload.id); deleteErr != nil {
+						logger.Request(r).Error("Error deleting upload", "error", deleteErr)
+					}
+					if errors.Is(err, errQuotaExceeded) {
+						respondQuotaExceeded(w, username, true)
+						return
+					}
+					respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+					logger.Request(r).Error("Error storing uploaded file", "error", err)
+					return
+				}
+				upload.fileId = &fileId
+
+				if _, err = db.Exec("UPDATE uploads SET file_id = ? WHERE id = ?", fileId, upload.id); err != nil {
+					// Without the file ID, HEAD couldn't report the upload as complete, so it's undone for the client to start again
+					respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+					logger.Request(r).Error("Error marking upload as complete", "error", err)
+					if err = removeFile(fileId); err != nil {
+						logger.Request(r).Error("Error deleting file", "fileId", fileId, "error", err)
+					}
+					if err = deleteTusUpload(upload.id); err != nil {
+						logger.Request(r).Error("Error deleting upload", "error", err)
+					}
+					return
+				}
+				logger.Request(r).Info("File uploaded", "fileId", fileId)
+				audit(r, "file.upload", fileId, upload.fileName)
+			}
+		}
+
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		if upload.fileId != nil {
+			// Nothing more can be appended, so the lock isn't needed anymore
+			uploadLocks.Delete(upload.id)
+			w.Header().Set("Eulm-File-Id", *upload.fileId)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))).Methods("PATCH")
+
+	r.HandleFunc("/tus/{uploadId}", tusHandler(validatePerms(ReadWriteSelf, ScopeUpload, func(w http.ResponseWriter, r *http.Request) {
+		lock, _ := uploadLocks.LoadOrStore(mux.Vars(r)["uploadId"], &sync.Mutex{})
+		if !lock.(*sync.Mutex).TryLock() {
+			respondJSON(w, http.StatusConflict, map[string]any{"message": "Upload is already in progress"})
+			return
+		}
+		defer lock.(*sync.Mutex).Unlock()
+
+		upload, ok := getTusUpload(w, r)
+		if !ok {
+			// Locks for uploads that don't exist would otherwise pile up
+			uploadLocks.Delete(mux.Vars(r)["uploadId"])
+			return
+		}
+
+		if upload.fileId == nil {
+			filePath := partialPath(upload.id)
+			if err := os.Remove(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Error("Error deleting file", "path", filePath, "error", err)
+				return
+			}
+		}
+
+		if _, err := db.Exec("DELETE FROM uploads WHERE id = ?", upload.id); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error deleting upload", "error", err)
+			return
+		}
+		uploadLocks.Delete(upload.id)
+
+		w.WriteHeader(http.StatusNoContent)
+	}))).Methods("DELETE")
+}
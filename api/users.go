@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gorilla/mux"
+	"github.com/mattn/go-sqlite3"
+)
+
+type User struct {
+	Username      string          `json:"username"`
+	Permissions   PermissionLevel `json:"permissions"`
+	Disabled      bool            `json:"disabled"`
+	QuotaBytes    *int64          `json:"quotaBytes"`
+	QuotaFiles    *int64          `json:"quotaFiles"`
+	MaxUploadSize *int64          `json:"maxUploadSize"`
+}
+
+type CreateUserRequestBody struct {
+	Username    string          `json:"username"`
+	Permissions PermissionLevel `json:"permissions"`
+}
+
+// UpdateUserRequestBody leaves out fields that aren't changing, with a quota of 0 meaning unlimited
+// and a max upload size of 0 meaning the default for the user's permission level
+type UpdateUserRequestBody struct {
+	Permissions   *PermissionLevel `json:"permissions,omitempty"`
+	Disabled      *bool            `json:"disabled,omitempty"`
+	QuotaBytes    *int64           `json:"quotaBytes,omitempty"`
+	QuotaFiles    *int64           `json:"quotaFiles,omitempty"`
+	MaxUploadSize *int64           `json:"maxUploadSize,omitempty"`
+}
+
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,32}$`)
+
+func (p PermissionLevel) valid() bool {
+	return p >= NoPerms && p <= Administrator
+}
+
+var errUserExists = errors.New("a user with this username already exists")
+
+// createUser adds a user along with a default token that has every scope, returning the token's API key
+func createUser(username string, perms PermissionLevel) (Token, string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Token{}, "", err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// The UNIQUE constraint decides whether the username is taken, so two requests can't both create it
+	if _, err = tx.Exec("INSERT INTO users (username, permissions) VALUES (?, ?)", username, perms); err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return Token{}, "", errUserExists
+		}
+		return Token{}, "", err
+	}
+
+	token, apiKey, err := createToken(tx, username, "default", AllScopes, nil)
+	if err != nil {
+		return Token{}, "", err
+	}
+
+	return token, apiKey, tx.Commit()
+}
+
+// deleteUser removes a user with their tokens and collections, as long as they don't have any files left, returning
+// whether the user was deleted and, if not, how many files they have
+func deleteUser(username string) (bool, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Tokens go first so none are left behind to resolve to a user that doesn't exist
+	if _, err = tx.Exec("DELETE FROM tokens WHERE username = ?", username); err != nil {
+		return false, 0, err
+	}
+	if _, err = tx.Exec(
+		"DELETE FROM collection_files WHERE collection_id IN (SELECT id FROM collections WHERE owner = ?)", username,
+	); err != nil {
+		return false, 0, err
+	}
+	if _, err = tx.Exec("DELETE FROM collections WHERE owner = ?", username); err != nil {
+		return false, 0, err
+	}
+
+	// Checking for files in the same statement stops one being uploaded in between
+	res, err := tx.Exec(
+		"DELETE FROM users WHERE username = ? AND NOT EXISTS (SELECT 1 FROM files WHERE creator = ?)", username, username,
+	)
+	if err != nil {
+		return false, 0, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, 0, err
+	}
+	if affected == 0 {
+		var files int
+		err = tx.QueryRow("SELECT COUNT(*) FROM files WHERE creator = ?", username).Scan(&files)
+		return false, files, err
+	}
+
+	return true, 0, tx.Commit()
+}
+
+func handleAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/users", validatePerms(Administrator, ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		var body CreateUserRequestBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid JSON body"})
+			return
+		}
+
+		if !usernameRegex.MatchString(body.Username) {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid username"})
+			return
+		}
+		if !body.Permissions.valid() {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid permission level"})
+			return
+		}
+
+		token, apiKey, err := createUser(body.Username, body.Permissions)
+		if errors.Is(err, errUserExists) {
+			respondJSON(w, http.StatusConflict, map[string]any{"message": "User already exists"})
+			return
+		} else if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error creating user", "error", err)
+			return
+		}
+
+		logger.Request(r).Info("User created", "username", body.Username)
+		audit(r, "user.create", body.Username, auditDetail(body))
+		respondJSON(w, http.StatusCreated, map[string]any{
+			"message": "User created successfully",
+			"user":    User{Username: body.Username, Permissions: body.Permissions},
+			"token":   token,
+			"apiKey":  apiKey,
+		})
+	})).Methods("POST")
+
+	r.HandleFunc("/admin/users", validatePerms(Administrator, ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		rows, err := db.Query("SELECT username, permissions, disabled, quota_bytes, quota_files, max_upload_size FROM users ORDER BY username")
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Warn("Error querying users", "error", err)
+			return
+		}
+		defer func(rows *sql.Rows) {
+			if err = rows.Close(); err != nil {
+				logger.Request(r).Error("Error closing queried rows", "error", err)
+			}
+		}(rows)
+
+		users := []User{}
+		for rows.Next() {
+			var user User
+			if err = rows.Scan(&user.Username, &user.Permissions, &user.Disabled, &user.QuotaBytes, &user.QuotaFiles, &user.MaxUploadSize); err != nil {
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Warn("Error reading queried row", "error", err)
+				return
+			}
+			users = append(users, user)
+		}
+
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message": "Users fetched successfully",
+			"users":   users,
+		})
+	})).Methods("GET")
+
+	r.HandleFunc("/admin/users/{username}", validatePerms(Administrator, ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		username := mux.Vars(r)["username"]
+
+		if username == masterUsername {
+			respondJSON(w, http.StatusForbidden, map[string]any{"message": "The Master user can't be modified"})
+			return
+		}
+
+		var body UpdateUserRequestBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid JSON body"})
+			return
+		}
+		if body.Permissions != nil && !body.Permissions.valid() {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid permission level"})
+			return
+		}
+		if (body.QuotaBytes != nil && *body.QuotaBytes < 0) || (body.QuotaFiles != nil && *body.QuotaFiles < 0) {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Quotas can't be negative"})
+			return
+		}
+		if body.MaxUploadSize != nil && *body.MaxUploadSize < 0 {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "The max upload size can't be negative"})
+			return
+		}
+
+		var user User
+		if err := db.QueryRow(
+			"SELECT username, permissions, disabled, quota_bytes, quota_files, max_upload_size FROM users WHERE username = ?", username,
+		).Scan(&user.Username, &user.Permissions, &user.Disabled, &user.QuotaBytes, &user.QuotaFiles, &user.MaxUploadSize); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				respondJSON(w, http.StatusNotFound, map[string]any{"message": "User not found"})
+				return
+			}
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying user from username", "error", err)
+			return
+		}
+
+		if body.Permissions != nil {
+			user.Permissions = *body.Permissions
+		}
+		if body.Disabled != nil {
+			user.Disabled = *body.Disabled
+		}
+		if body.QuotaBytes != nil {
+			user.QuotaBytes = body.QuotaBytes
+			if *body.QuotaBytes == 0 {
+				user.QuotaBytes = nil
+			}
+		}
+		if body.QuotaFiles != nil {
+			user.QuotaFiles = body.QuotaFiles
+			if *body.QuotaFiles == 0 {
+				user.QuotaFiles = nil
+			}
+		}
+		if body.MaxUploadSize != nil {
+			user.MaxUploadSize = body.MaxUploadSize
+			if *body.MaxUploadSize == 0 {
+				user.MaxUploadSize = nil
+			}
+		}
+
+		if _, err := db.Exec(
+			"UPDATE users SET permissions = ?, disabled = ?, quota_bytes = ?, quota_files = ?, max_upload_size = ? WHERE username = ?",
+			user.Permissions, user.Disabled, user.QuotaBytes, user.QuotaFiles, user.MaxUploadSize, username,
+		); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error updating user", "error", err)
+			return
+		}
+
+		logger.Request(r).Info("User updated")
+		audit(r, "user.update", username, auditDetail(body))
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message": "User updated successfully",
+			"user":    user,
+		})
+	})).Methods("PATCH")
+
+	r.HandleFunc("/admin/users/{username}", validatePerms(Administrator, ScopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+		username := mux.Vars(r)["username"]
+
+		if username == masterUsername {
+			respondJSON(w, http.StatusForbidden, map[string]any{"message": "The Master user can't be deleted"})
+			return
+		}
+
+		deleted, files, err := deleteUser(username)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error deleting user", "error", err)
+			return
+		}
+		if files > 0 {
+			respondJSON(w, http.StatusConflict, map[string]any{
+				"message": fmt.Sprintf("The user still has %d files - delete them first", files),
+				"files":   files,
+			})
+			return
+		}
+		if !deleted {
+			respondJSON(w, http.StatusNotFound, map[string]any{"message": "User not found"})
+			return
+		}
+
+		logger.Request(r).Info("User deleted")
+		audit(r, "user.delete", username, "")
+		respondJSON(w, http.StatusOK, map[string]any{"message": "User deleted successfully"})
+	})).Methods("DELETE")
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCreateUser(t *testing.T) {
+	setupTestDB(t)
+
+	_, apiKey, err := createUser("alice", ReadWriteSelf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, user, _, err := findToken(apiKey); err != nil || user.Username != "alice" {
+		t.Errorf("findToken() = %+v, %v, want alice", user, err)
+	}
+
+	if _, _, err = createUser("alice", Administrator); !errors.Is(err, errUserExists) {
+		t.Errorf("createUser() on an existing user error = %v, want errUserExists", err)
+	}
+
+	var perms PermissionLevel
+	var tokens int
+	if err = db.QueryRow(
+		"SELECT permissions, (SELECT COUNT(*) FROM tokens WHERE username = 'alice') FROM users WHERE username = 'alice'",
+	).Scan(&perms, &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if perms != ReadWriteSelf || tokens != 1 {
+		t.Errorf("alice has permissions %v and %d tokens, want the first user's and 1", perms, tokens)
+	}
+}
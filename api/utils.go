@@ -5,115 +5,115 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
-func colourCode(r, g, b uint8) string {
-	return fmt.Sprintf("\x1b[38;2;%d;%d;%dm", r, g, b)
-}
-
-type Logger struct {
-	timezone *time.Location
-
-	successCol string
-	infoCol    string
-	warnCol    string
-	errorCol   string
-	fatalCol   string
-
-	successDimCol string
-	infoDimCol    string
-	warnDimCol    string
-	errorDimCol   string
-	fatalDimCol   string
-
-	resetCode string
-}
-
-func (l *Logger) Info(args ...string) {
-	var str string
+// sqliteTimeFormat matches the output of SQLite's datetime(), so formatted times compare correctly against it
+const sqliteTimeFormat = "2006-01-02 15:04:05"
 
-	for _, val := range args {
-		str += val + " "
+func respondJSON(w http.ResponseWriter, status int, payload map[string]any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		logger.Error("Error writing JSON to response", "error", err)
 	}
-
-	t := time.Now().In(l.timezone).Format("02/01/2006 15:04:05")
-	fmt.Printf("%sINF %s - %s%s%s\n", l.infoDimCol, t, l.infoCol, str, l.resetCode)
 }
 
-func (l *Logger) Warn(args ...string) {
-	var str string
-
-	for _, val := range args {
-		str += val + " "
+// contentDisposition builds a Content-Disposition header with an ASCII fallback filename for old clients
+// and the full name encoded as described in RFC 5987
+func contentDisposition(dispositionType string, fileName string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, fileName)
+
+	var encoded strings.Builder
+	for _, b := range []byte(fileName) {
+		if ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z') || ('0' <= b && b <= '9') || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			encoded.WriteString(fmt.Sprintf("%%%02X", b))
+		}
 	}
 
-	t := time.Now().In(l.timezone).Format("02/01/2006 15:04:05")
-	fmt.Printf("%sWRN %s - %s%s%s\n", l.warnDimCol, t, l.warnCol, str, l.resetCode)
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", dispositionType, fallback, encoded.String())
 }
 
-func (l *Logger) Error(args ...string) {
-	var str string
-
-	for _, val := range args {
-		str += val + " "
+// respondFile streams a file from disk, handling HEAD, range and conditional requests through http.ServeContent.
+// Files are shown inline when their type is safe to, unless the download query parameter is set
+func respondFile(w http.ResponseWriter, r *http.Request, fileName string, mimeType string, file *os.File) {
+	info, err := file.Stat()
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Request(r).Error("Error reading file info", "error", err)
+		return
 	}
 
-	t := time.Now().In(l.timezone).Format("02/01/2006 15:04:05")
-	fmt.Printf("%sERR %s - %s%s%s\n", l.errorDimCol, t, l.errorCol, str, l.resetCode)
-}
-
-func (l *Logger) Fatal(args ...string) {
-	var str string
+	w, done := trackDownload(w)
+	defer done()
 
-	for _, val := range args {
-		str += val + " "
+	dispositionType := "attachment"
+	if download, _ := strconv.ParseBool(r.URL.Query().Get("download")); !download && isInlineMimeType(mimeType) {
+		dispositionType = "inline"
 	}
 
-	t := time.Now().In(l.timezone).Format("02/01/2006 15:04:05")
-	fmt.Printf("%sERR %s - %s%s%s\n", l.fatalDimCol, t, l.fatalCol, str, l.resetCode)
-
-	os.Exit(1)
+	w.Header().Set("Content-Disposition", contentDisposition(dispositionType, fileName))
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size()))
+	http.ServeContent(w, r, fileName, info.ModTime(), file)
 }
 
-func newLogger() *Logger {
-	location, err := time.LoadLocation("Europe/London")
-	if err != nil {
-		location = time.Local
+// parseDuration extends time.ParseDuration with day (d) and week (w) units, e.g. "7d" or "2w"
+func parseDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, found := strings.CutSuffix(s, suffix); found {
+			count, err := strconv.Atoi(n)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(count) * unit, nil
+		}
 	}
+	return time.ParseDuration(s)
+}
 
-	return &Logger{
-		timezone: location,
-
-		infoCol:  colourCode(233, 215, 90),
-		warnCol:  colourCode(255, 135, 47),
-		errorCol: colourCode(255, 70, 50),
-		fatalCol: colourCode(181, 29, 29),
+var sizeUnits = map[string]int64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30, "TB": 1 << 40}
 
-		infoDimCol:  colourCode(202, 191, 111),
-		warnDimCol:  colourCode(216, 140, 84),
-		errorDimCol: colourCode(216, 98, 86),
-		fatalDimCol: colourCode(169, 72, 72),
+// formatSize formats a number of bytes with the largest unit that keeps it at least 1, e.g. 1.5 MB
+func formatSize(bytes int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size, unit := float64(bytes), 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
 
-		resetCode: "\x1b[0m",
+	if unit == 0 {
+		return fmt.Sprintf("%d B", bytes)
 	}
+	return fmt.Sprintf("%.1f %s", size, units[unit])
 }
 
-var logger = newLogger()
+// parseSize reads a number of bytes with an optional binary unit, e.g. "1048576", "500MB" or "2GB"
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
 
-func respondJSON(w http.ResponseWriter, status int, payload map[string]any) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	if err := json.NewEncoder(w).Encode(payload); err != nil {
-		logger.Error("Error writing JSON to response:", err.Error())
+	multiplier := int64(1)
+	for suffix, unit := range sizeUnits {
+		if n, found := strings.CutSuffix(s, suffix); found {
+			s, multiplier = strings.TrimSpace(n), unit
+			break
+		}
 	}
-}
 
-func respondFile(w http.ResponseWriter, status int, fileName string, fileData []byte) {
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.WriteHeader(status)
-	if _, err := w.Write(fileData); err != nil {
-		logger.Error("Error writing file data to response:", err.Error())
+	n, err := strconv.ParseInt(strings.TrimSuffix(s, "B"), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
 	}
+	return n * multiplier, nil
 }
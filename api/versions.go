@@ -0,0 +1,367 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// When a file's data is replaced, the previous data is kept as a numbered version at db/<id>.v<version>.dat.
+// Files start at version 1, and each replacement or restore adds one. Old versions count towards their
+// creator's storage quota until they're pruned by count or age
+
+type FileVersion struct {
+	Version    int     `json:"version"`
+	Size       int64   `json:"size"`
+	MimeType   string  `json:"mimeType"`
+	Checksum   *string `json:"checksum"`
+	CreatedAt  string  `json:"createdAt"`
+	ReplacedAt *string `json:"replacedAt"`
+	Current    bool    `json:"current"`
+}
+
+// keepVersions is how many previous versions are kept for each file, with 0 turning versioning off
+var keepVersions = 10
+
+// versionMaxAge is how long a version is kept after being replaced, with 0 keeping them until there are too many
+var versionMaxAge time.Duration
+
+func loadVersionRetention() error {
+	if value := os.Getenv("EULM_FILES_VERSIONS_KEEP"); value != "" {
+		keep, err := strconv.Atoi(value)
+		if err != nil || keep < 0 {
+			return fmt.Errorf("EULM_FILES_VERSIONS_KEEP: invalid count %q", value)
+		}
+		keepVersions = keep
+	}
+
+	if value := os.Getenv("EULM_FILES_VERSIONS_MAX_AGE"); value != "" {
+		maxAge, err := parseDuration(value)
+		if err != nil || maxAge < 0 {
+			return fmt.Errorf("EULM_FILES_VERSIONS_MAX_AGE: invalid duration %q", value)
+		}
+		versionMaxAge = maxAge
+	}
+
+	return nil
+}
+
+func versionPath(fileId string, version int) string {
+	return fmt.Sprintf("db/%s.v%d.dat", fileId, version)
+}
+
+// archiveCurrentVersion records a file's current data as an old version, hard linking it to its version path so
+// downloads in progress aren't affected when the file's data is replaced. It returns the path to remove if the
+// replacement fails
+func archiveCurrentVersion(tx *sql.Tx, fileId string) (string, error) {
+	var version int
+	if err := tx.QueryRow(
+		`INSERT INTO file_versions (file_id, version, size, mime_type, checksum, created_at, replaced_at)
+		SELECT id, version, size, mime_type, checksum, COALESCE(modified_at, uploaded_at), datetime('now') FROM files WHERE id = ?
+		RETURNING version`,
+		fileId,
+	).Scan(&version); err != nil {
+		return "", err
+	}
+
+	path := versionPath(fileId, version)
+	if err := os.Link(blobPath(fileId), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func removeVersion(fileId string, version int) error {
+	if _, err := db.Exec("DELETE FROM file_versions WHERE file_id = ? AND version = ?", fileId, version); err != nil {
+		return err
+	}
+
+	path := versionPath(fileId, version)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// removeVersions deletes all of a file's old versions
+func removeVersions(fileId string) error {
+	if _, err := db.Exec("DELETE FROM file_versions WHERE file_id = ?", fileId); err != nil {
+		return err
+	}
+
+	paths, err := filepath.Glob(fmt.Sprintf("db/%s.v*.dat", fileId))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err = os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneVersions deletes versions that are too old or beyond the number kept, from the given file or every
+// file if fileId is empty
+func pruneVersions(fileId string) error {
+	query := `SELECT file_id, version FROM (
+		SELECT file_id, version, replaced_at, ROW_NUMBER() OVER (PARTITION BY file_id ORDER BY version DESC) AS position
+		FROM file_versions WHERE ? = '' OR file_id = ?
+	) WHERE position > ?`
+	args := []any{fileId, fileId, keepVersions}
+	if versionMaxAge > 0 {
+		query += " OR replaced_at <= ?"
+		args = append(args, time.Now().Add(-versionMaxAge).UTC().Format(sqliteTimeFormat))
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+
+	type fileVersion struct {
+		fileId  string
+		version int
+	}
+	var versions []fileVersion
+	for rows.Next() {
+		var v fileVersion
+		if err = rows.Scan(&v.fileId, &v.version); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		versions = append(versions, v)
+	}
+	if err = rows.Close(); err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		if err = removeVersion(v.fileId, v.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveVersion sends an old version of a file. Versions of files with a download limit are only available to the
+// owner, since they don't count towards the limit
+func serveVersion(w http.ResponseWriter, r *http.Request, fileId string, stored storedFile, versionParam string) {
+	version, err := strconv.Atoi(versionParam)
+	if err != nil || version <= 0 {
+		respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid version - use a positive whole number"})
+		return
+	}
+
+	if stored.maxDownloads != nil && !checkOwnerKey(r, stored.creator) {
+		respondJSON(w, http.StatusForbidden, map[string]any{
+			"message": "Old versions of files with a download limit are only available to the owner",
+		})
+		return
+	}
+
+	var mimeType string
+	if err = db.QueryRow("SELECT mime_type FROM file_versions WHERE file_id = ? AND version = ?", fileId, version).Scan(&mimeType); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondJSON(w, http.StatusNotFound, map[string]any{"message": "Version not found"})
+			return
+		}
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Request(r).Error("Error querying file version", "error", err)
+		return
+	}
+
+	filePath := versionPath(fileId, version)
+	file, err := os.Open(filePath)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+		logger.Request(r).Error("Error opening file", "path", filePath, "error", err)
+		return
+	}
+	defer func(file *os.File) {
+		if err = file.Close(); err != nil {
+			logger.Request(r).Error("Error closing file", "path", filePath, "error", err)
+		}
+	}(file)
+
+	respondFile(w, r, stored.name, mimeType, file)
+}
+
+// linkOrCopy makes a new file at dst with the same data as src, sharing it when the filesystem allows
+func linkOrCopy(src string, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func(srcFile *os.File) {
+		if err = srcFile.Close(); err != nil {
+			logger.Error("Error closing file", "path", src, "error", err)
+		}
+	}(srcFile)
+
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dstFile, srcFile)
+	if closeErr := dstFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func handleVersions(r *mux.Router) {
+	r.HandleFunc("/{fileId}/versions", func(w http.ResponseWriter, r *http.Request) {
+		fileId := mux.Vars(r)["fileId"]
+
+		stored, ok := authorizeDownload(w, r, fileId)
+		if !ok {
+			return
+		}
+
+		// The same goes for listing versions as for serving them, see serveVersion
+		owner := stored.maxDownloads != nil && checkOwnerKey(r, stored.creator)
+		if stored.maxDownloads != nil && !owner {
+			respondJSON(w, http.StatusForbidden, map[string]any{
+				"message": "Old versions of files with a download limit are only available to the owner",
+			})
+			return
+		}
+
+		checksum, err := fileChecksum(fileId)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error calculating checksum of file", "error", err)
+			return
+		}
+
+		current := FileVersion{Checksum: &checksum, Current: true}
+		if err = db.QueryRow(
+			"SELECT version, size, mime_type, COALESCE(modified_at, uploaded_at) FROM files WHERE id = ?", fileId,
+		).Scan(&current.Version, &current.Size, &current.MimeType, &current.CreatedAt); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying file from ID", "error", err)
+			return
+		}
+
+		rows, err := db.Query(
+			`SELECT version, size, mime_type, checksum, created_at, replaced_at FROM file_versions
+			WHERE file_id = ? ORDER BY version DESC`,
+			fileId,
+		)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying file versions", "error", err)
+			return
+		}
+		defer func(rows *sql.Rows) {
+			if err = rows.Close(); err != nil {
+				logger.Request(r).Error("Error closing queried rows", "error", err)
+			}
+		}(rows)
+
+		versions := []FileVersion{current}
+		for rows.Next() {
+			var version FileVersion
+			if err = rows.Scan(&version.Version, &version.Size, &version.MimeType, &version.Checksum, &version.CreatedAt, &version.ReplacedAt); err != nil {
+				respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+				logger.Request(r).Warn("Error reading queried row", "error", err)
+				return
+			}
+			versions = append(versions, version)
+		}
+
+		if stored.private || stored.passwordHash != nil || owner {
+			w.Header().Set("Cache-Control", "private, no-store")
+		}
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message":  "Versions fetched successfully",
+			"versions": versions,
+		})
+	}).Methods("GET")
+
+	// Restoring makes an old version's data current again as a new version, so the data it replaces is kept too
+	r.HandleFunc("/{fileId}/versions/{version}/restore", validatePerms(ReadWriteSelf, ScopeModify, func(w http.ResponseWriter, r *http.Request) {
+		fileId := mux.Vars(r)["fileId"]
+
+		version, err := strconv.Atoi(mux.Vars(r)["version"])
+		if err != nil || version <= 0 {
+			respondJSON(w, http.StatusBadRequest, map[string]any{"message": "Invalid version - use a positive whole number"})
+			return
+		}
+
+		if !authorizeFileOwner(w, r, fileId) {
+			return
+		}
+
+		var count int
+		if err = db.QueryRow("SELECT COUNT(*) FROM file_versions WHERE file_id = ? AND version = ?", fileId, version).Scan(&count); err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying file version", "error", err)
+			return
+		}
+		if count == 0 {
+			respondJSON(w, http.StatusNotFound, map[string]any{"message": "Version not found"})
+			return
+		}
+
+		tempFile, err := os.CreateTemp(partialDir, "restore-*.part")
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error creating temporary file", "error", err)
+			return
+		}
+		tempPath := tempFile.Name()
+		if err = tempFile.Close(); err == nil {
+			if err = os.Remove(tempPath); err == nil {
+				err = linkOrCopy(versionPath(fileId, version), tempPath)
+			}
+		}
+		if err == nil {
+			err = replaceFileContent(fileId, tempPath)
+		}
+		if err != nil {
+			if removeErr := os.Remove(tempPath); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+				logger.Request(r).Error("Error deleting file", "path", tempPath, "error", removeErr)
+			}
+
+			if errors.Is(err, errQuotaExceeded) {
+				respondReplaceQuotaExceeded(w, fileId)
+				return
+			}
+			if errors.Is(err, errVersionConflict) {
+				respondVersionConflict(w)
+				return
+			}
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error restoring version", "error", err)
+			return
+		}
+
+		file, err := scanFile(db.QueryRow("SELECT "+fileColumns+" FROM files WHERE id = ?", fileId))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]any{"message": "An unexpected error occurred"})
+			logger.Request(r).Error("Error querying file from ID", "error", err)
+			return
+		}
+
+		logger.Request(r).Info("Version restored", "newVersion", file.Version)
+		audit(r, "file.restore", fileId, fmt.Sprintf("version %d restored as version %d", version, file.Version))
+		respondJSON(w, http.StatusOK, map[string]any{
+			"message": fmt.Sprintf("Version %d restored successfully", version),
+			"file":    file,
+		})
+	})).Methods("POST")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+
+    "golang.org/x/term"
+)
+
+type AuditEvent struct {
+    Id        int64   `json:"id"`
+    CreatedAt string  `json:"createdAt"`
+    Actor     *string `json:"actor"`
+    Action    string  `json:"action"`
+    Target    *string `json:"target"`
+    IP        *string `json:"ip"`
+    UserAgent *string `json:"userAgent"`
+    Result    string  `json:"result"`
+    Detail    *string `json:"detail"`
+}
+
+type AuditResponseBody struct {
+    Events     []AuditEvent `json:"events"`
+    NextCursor *string      `json:"nextCursor"`
+}
+
+// auditOptions maps the audit flags to the query parameters they set
+var auditOptions = []string{"actor", "action", "target", "result", "from", "to", "limit", "cursor"}
+
+// orDash shows missing values in tables
+func orDash(s *string) string {
+    if s == nil {
+        return "-"
+    }
+    return *s
+}
+
+func auditCmd() {
+    query := url.Values{}
+    for _, option := range auditOptions {
+        if value := flags[option]; value != "" {
+            query.Set(option, value)
+        }
+    }
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    stdin := bufio.NewReader(os.Stdin)
+    interactive := term.IsTerminal(int(os.Stdin.Fd()))
+
+    for {
+        resBody, ok := fetchAuditPage(apiKey, query)
+        if !ok {
+            return
+        }
+
+        if len(resBody.Events) == 0 {
+            fmt.Println("No audit events found")
+            return
+        }
+
+        rows := [][]string{{"Time", "Actor", "Action", "Target", "Result", "IP", "Detail"}}
+        for _, event := range resBody.Events {
+            rows = append(rows, []string{
+                event.CreatedAt, orDash(event.Actor), event.Action, orDash(event.Target), event.Result,
+                orDash(event.IP), orDash(event.Detail),
+            })
+        }
+
+        fmt.Println()
+        printTable(rows)
+        fmt.Println()
+
+        if resBody.NextCursor == nil {
+            return
+        }
+
+        if !interactive {
+            fmt.Printf("There are more events - use --cursor %s to see the next page\n", *resBody.NextCursor)
+            return
+        }
+        fmt.Print("There are more events - press Enter to see the next page or q to stop: ")
+        answer, err := stdin.ReadString('\n')
+        if err != nil || strings.TrimSpace(strings.ToLower(answer)) == "q" {
+            return
+        }
+        query.Set("cursor", *resBody.NextCursor)
+    }
+}
+
+// fetchAuditPage fetches one page of the audit log, printing why if it couldn't
+func fetchAuditPage(apiKey string, query url.Values) (AuditResponseBody, bool) {
+    var resBody AuditResponseBody
+
+    req, err := newJSONRequest("GET", "/admin/audit", apiKey, nil)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return resBody, false
+    }
+    req.URL.RawQuery = query.Encode()
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return resBody, false
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusOK {
+        if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+            fmt.Println("Error parsing response body")
+            return resBody, false
+        }
+        return resBody, true
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error fetching audit events"))
+    }
+    return resBody, false
+}
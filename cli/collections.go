@@ -0,0 +1,278 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+)
+
+type Collection struct {
+    Id        string `json:"id"`
+    Name      string `json:"name"`
+    Owner     string `json:"owner"`
+    CreatedAt string `json:"createdAt"`
+    FileCount int    `json:"fileCount"`
+}
+
+type CreateCollectionResponseBody struct {
+    Collection Collection `json:"collection"`
+}
+
+type ListCollectionsResponseBody struct {
+    Collections []Collection `json:"collections"`
+}
+
+type CollectionResponseBody struct {
+    Collection Collection `json:"collection"`
+    Files      []File     `json:"files"`
+}
+
+func collectionUrl(collectionId string) string {
+    collectionUrl, err := url.JoinPath(apiUrl, "/c/"+collectionId)
+    if err != nil {
+        return "/c/" + collectionId
+    }
+    return collectionUrl
+}
+
+func collectionCmd() {
+    if len(args) < 2 {
+        fmt.Println("A collection subcommand is required (create, add, list, rm)")
+        return
+    }
+
+    if args[1] == "create" {
+        collectionCreateCmd()
+    } else if args[1] == "add" {
+        collectionAddCmd()
+    } else if args[1] == "list" {
+        collectionListCmd()
+    } else if args[1] == "rm" {
+        collectionRemoveCmd()
+    } else {
+        fmt.Println("Unknown collection subcommand (maybe try `help` instead)")
+    }
+}
+
+func collectionCreateCmd() {
+    if len(args) < 3 {
+        fmt.Println("The collection name is required")
+        return
+    }
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("POST", "/collections", apiKey, map[string]any{"name": args[2]})
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusCreated {
+        var resBody CreateCollectionResponseBody
+        if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+            fmt.Println("Error parsing response body")
+            return
+        }
+        fmt.Printf("Collection %s (%s) created\n", resBody.Collection.Id, resBody.Collection.Name)
+        fmt.Printf("Link: %s\n", collectionUrl(resBody.Collection.Id))
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error creating collection"))
+    }
+}
+
+func collectionAddCmd() {
+    if len(args) < 4 {
+        fmt.Println("The collection ID and at least one file ID are required")
+        return
+    }
+
+    collectionId := args[2]
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    for _, fileId := range args[3:] {
+        req, err := newJSONRequest("POST", "/collections/"+collectionId+"/files", apiKey, map[string]any{"fileId": fileId})
+        if err != nil {
+            fmt.Println("Error creating request")
+            return
+        }
+
+        res, err := client.Do(req)
+        if err != nil {
+            fmt.Println("Error sending request")
+            return
+        }
+
+        if res.StatusCode == http.StatusOK {
+            fmt.Printf("Added %s to the collection\n", fileId)
+        } else if res.StatusCode == http.StatusUnauthorized {
+            fmt.Println("Invalid API key or insufficient permissions")
+        } else {
+            fmt.Printf("%s: %s\n", fileId, responseMessage(res, "Error adding file to collection"))
+        }
+
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }
+}
+
+func collectionListCmd() {
+    path := "/collections"
+    if len(args) >= 3 {
+        path += "/" + args[2]
+    }
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("GET", path, apiKey, nil)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+        return
+    } else if res.StatusCode != http.StatusOK {
+        fmt.Println(responseMessage(res, "Error fetching collections"))
+        return
+    }
+
+    // With a collection ID, list the files in that collection
+    if len(args) >= 3 {
+        var resBody CollectionResponseBody
+        if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+            fmt.Println("Error parsing response body")
+            return
+        }
+
+        fmt.Printf("\n%s (%s)\n\n", resBody.Collection.Name, collectionUrl(resBody.Collection.Id))
+        if len(resBody.Files) == 0 {
+            fmt.Println("No files in this collection")
+            return
+        }
+
+        rows := [][]string{{"ID", "Name", "Size", "Uploaded at", "Shown"}}
+        for _, file := range resBody.Files {
+            // The public page leaves out files that need a password or an API key
+            shown := "yes"
+            if file.Private || file.HasPassword {
+                shown = "no"
+            }
+            rows = append(rows, []string{file.Id, file.Name, formatSize(file.Size), file.UploadedAt, shown})
+        }
+        printTable(rows)
+        fmt.Println()
+        return
+    }
+
+    var resBody ListCollectionsResponseBody
+    if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+        fmt.Println("Error parsing response body")
+        return
+    }
+
+    if len(resBody.Collections) == 0 {
+        fmt.Println("No collections found")
+        return
+    }
+
+    rows := [][]string{{"ID", "Name", "Owner", "Files", "Created at", "URL"}}
+    for _, collection := range resBody.Collections {
+        rows = append(rows, []string{
+            collection.Id, collection.Name, collection.Owner, fmt.Sprint(collection.FileCount), collection.CreatedAt,
+            collectionUrl(collection.Id),
+        })
+    }
+
+    fmt.Println()
+    printTable(rows)
+    fmt.Println()
+}
+
+func collectionRemoveCmd() {
+    if len(args) < 3 {
+        fmt.Println("The collection ID is required")
+        return
+    }
+
+    // Without a file ID the whole collection is deleted, leaving its files alone
+    path := "/collections/" + args[2]
+    if len(args) >= 4 {
+        path += "/files/" + args[3]
+    }
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("DELETE", path, apiKey, nil)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusOK {
+        if len(args) >= 4 {
+            fmt.Println("File removed from collection successfully")
+        } else {
+            fmt.Println("Collection deleted successfully")
+        }
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error removing from collection"))
+    }
+}
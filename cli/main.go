@@ -1,14 +1,15 @@
 package main
 
 import (
+    "bufio"
+    "bytes"
     "encoding/json"
     "fmt"
     "io"
-    "mime/multipart"
     "net/http"
     "net/url"
     "os"
-    "path/filepath"
+    "strconv"
     "strings"
     "time"
 
@@ -16,36 +17,240 @@ import (
 )
 
 type File struct {
-    Id         string `json:"id"`
-    Name       string `json:"name"`
-    UploadedAt string `json:"uploadedAt"`
-    Creator    string `json:"creator"`
+    Id            string   `json:"id"`
+    Name          string   `json:"name"`
+    UploadedAt    string   `json:"uploadedAt"`
+    Creator       string   `json:"creator"`
+    ExpiresAt     *string  `json:"expiresAt"`
+    MaxDownloads  *int     `json:"maxDownloads"`
+    DownloadCount int      `json:"downloadCount"`
+    HasPassword   bool     `json:"hasPassword"`
+    Private       bool     `json:"private"`
+    Size          int64    `json:"size"`
+    Description   string   `json:"description"`
+    Tags          []string `json:"tags"`
+    Version       int      `json:"version"`
 }
 
-type UploadResponseBody struct {
-    Id string `json:"id"`
+type ListResponseBody struct {
+    Files      []File  `json:"files"`
+    NextCursor *string `json:"nextCursor"`
 }
 
-type ListResponseBody struct {
-    Files []File `json:"files"`
+type FileInfo struct {
+    Id            string   `json:"id"`
+    Name          string   `json:"name"`
+    Size          int64    `json:"size"`
+    MimeType      string   `json:"mimeType"`
+    Checksum      *string  `json:"checksum"`
+    Creator       string   `json:"creator"`
+    UploadedAt    string   `json:"uploadedAt"`
+    ExpiresAt     *string  `json:"expiresAt"`
+    DownloadCount *int     `json:"downloadCount"`
+    Version       int      `json:"version"`
+    Owner         bool     `json:"owner"`
+    MaxDownloads  *int     `json:"maxDownloads"`
+    HasPassword   bool     `json:"hasPassword"`
+    Private       bool     `json:"private"`
+    Description   string   `json:"description"`
+    Tags          []string `json:"tags"`
+    Collections   []string `json:"collections"`
+}
+
+type FileVersion struct {
+    Version    int     `json:"version"`
+    Size       int64   `json:"size"`
+    MimeType   string  `json:"mimeType"`
+    Checksum   *string `json:"checksum"`
+    CreatedAt  string  `json:"createdAt"`
+    ReplacedAt *string `json:"replacedAt"`
+    Current    bool    `json:"current"`
+}
+
+type VersionsResponseBody struct {
+    Versions []FileVersion `json:"versions"`
+}
+
+type FileInfoResponseBody struct {
+    File FileInfo `json:"file"`
+}
+
+type UpdateFileResponseBody struct {
+    File File `json:"file"`
+}
+
+type ShareResponseBody struct {
+    Path      string `json:"path"`
+    ExpiresAt string `json:"expiresAt"`
+}
+
+type Usage struct {
+    Bytes        int64  `json:"bytes"`
+    VersionBytes int64  `json:"versionBytes"`
+    Files        int64  `json:"files"`
+    QuotaBytes   *int64 `json:"quotaBytes"`
+    QuotaFiles   *int64 `json:"quotaFiles"`
 }
 
-var args = parseArgs()
+type UsageResponseBody struct {
+    Usage Usage `json:"usage"`
+}
+
+type MessageResponseBody struct {
+    Message string `json:"message"`
+}
+
+var args, flags = parseArgs()
 var client = &http.Client{Timeout: 30 * time.Second}
 
+// transferClient has no overall timeout since uploads can take much longer than normal requests
+var transferClient = &http.Client{}
+
 var version = "v1.0.0"
 var apiUrl = "https://files.eulm.dev"
 
-func parseArgs() []string {
-    var validArgs []string
+// boolFlags don't take a value, so the argument following them isn't consumed
+var boolFlags = map[string]bool{"burn": true, "password": true, "private": true, "public": true}
+
+// parseArgs splits the command line into positional arguments and flags,
+// accepting both "--name value" and "--name=value"
+func parseArgs() ([]string, map[string]string) {
+    var positional []string
+    parsedFlags := map[string]string{}
+
+    osArgs := os.Args[1:]
+    for i := 0; i < len(osArgs); i++ {
+        arg := osArgs[i]
+
+        if arg == "--" {
+            positional = append(positional, osArgs[i+1:]...)
+            break
+        }
+        if !strings.HasPrefix(arg, "-") || arg == "-" {
+            positional = append(positional, arg)
+            continue
+        }
+
+        name := strings.TrimLeft(arg, "-")
+        if name, value, found := strings.Cut(name, "="); found {
+            parsedFlags[name] = value
+        } else if boolFlags[name] || i+1 >= len(osArgs) {
+            parsedFlags[name] = "true"
+        } else {
+            parsedFlags[name] = osArgs[i+1]
+            i++
+        }
+    }
+
+    return positional, parsedFlags
+}
+
+func readApiKey() (string, error) {
+    fmt.Print("Enter your API key: ")
+    apiKey, err := term.ReadPassword(int(os.Stdin.Fd()))
+    if err != nil {
+        return "", err
+    }
+    fmt.Println("[ENTERED]")
 
-    for _, arg := range os.Args[1:] {
-        if !strings.HasPrefix(arg, "-") {
-            validArgs = append(validArgs, arg)
+    return string(apiKey), nil
+}
+
+func newJSONRequest(method string, path string, apiKey string, body any) (*http.Request, error) {
+    endpoint, err := url.JoinPath(apiUrl, path)
+    if err != nil {
+        return nil, err
+    }
+
+    var bodyReader io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return nil, err
         }
+        bodyReader = bytes.NewReader(data)
+    }
+
+    req, err := http.NewRequest(method, endpoint, bodyReader)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Add("Authorization", "Bearer "+apiKey)
+    if body != nil {
+        req.Header.Add("Content-Type", "application/json")
+    }
+
+    return req, nil
+}
+
+// responseMessage reads the message from an API error response, falling back to the given text
+func responseMessage(res *http.Response, fallback string) string {
+    var resBody MessageResponseBody
+    if err := json.NewDecoder(res.Body).Decode(&resBody); err != nil || resBody.Message == "" {
+        return fallback
+    }
+    return resBody.Message
+}
+
+var sizeUnits = []string{"B", "KB", "MB", "GB", "TB"}
+
+// formatSize formats a number of bytes with the largest unit that keeps it at least 1, e.g. 1.5 MB
+func formatSize(bytes int64) string {
+    size := float64(bytes)
+    unit := 0
+    for size >= 1024 && unit < len(sizeUnits)-1 {
+        size /= 1024
+        unit++
     }
 
-    return validArgs
+    if unit == 0 {
+        return fmt.Sprintf("%d B", bytes)
+    }
+    return fmt.Sprintf("%.1f %s", size, sizeUnits[unit])
+}
+
+// parseSize reads a size like 500MB, 10GB or a plain number of bytes, with none meaning no limit (0)
+func parseSize(s string) (int64, bool) {
+    s = strings.ToUpper(strings.TrimSpace(s))
+    if s == "NONE" {
+        return 0, true
+    }
+
+    multiplier := int64(1)
+    for i := len(sizeUnits) - 1; i > 0; i-- {
+        if number, found := strings.CutSuffix(s, sizeUnits[i]); found {
+            s = strings.TrimSpace(number)
+            multiplier = int64(1) << (10 * i)
+            break
+        }
+    }
+    s = strings.TrimSuffix(s, "B")
+
+    number, err := strconv.ParseFloat(s, 64)
+    if err != nil || number < 0 {
+        return 0, false
+    }
+    return int64(number * float64(multiplier)), true
+}
+
+// printTable prints rows as left-aligned columns, treating the first row as the header
+func printTable(rows [][]string) {
+    widths := map[int]int{}
+    for _, row := range rows {
+        for i, cell := range row {
+            if len(cell) > widths[i] {
+                widths[i] = len(cell)
+            }
+        }
+    }
+
+    for _, row := range rows {
+        cells := make([]string, len(row))
+        for i, cell := range row {
+            cells[i] = cell + strings.Repeat(" ", widths[i]-len(cell))
+        }
+        fmt.Println(strings.TrimRight(strings.Join(cells, " "), " "))
+    }
 }
 
 func printHelp() {
@@ -54,90 +259,189 @@ Eulm Files CLI %s
 
 help: Display this help page
 version: Display the CLI version
-upload [file path]: Upload a file from its path
+upload [file path]: Upload a file from its path, resuming the last attempt if it was interrupted
+    --expires [duration or time]: Delete the file after a duration (e.g. 12h, 7d) or at an RFC 3339 time
+    --max-downloads [count]: Delete the file after it has been downloaded this many times
+    --burn: Delete the file as soon as it has been downloaded once
+    --password: Ask for a password that's needed to download the file
+    --private: Only allow downloads with your API key or a link from "share"
+    --collection [collection ID]: Add the file to one of your collections
+    --tags [tags]: Tag the file, e.g. "holiday,beach"
+    --description [text]: Describe the file
 delete [file ID]: Delete a file from its ID
-list: List all uploaded files
+info [file ID]: Show a file's details and checksum without downloading it
+list: List uploaded files, a page at a time
+    --sort [name, uploaded or size]: What to sort by (default uploaded)
+    --order [asc or desc]: The sort order (default newest, largest or A to Z first)
+    --creator [username]: Only show files uploaded by this user
+    --from [date or time]: Only show files uploaded since this date (e.g. 2024-01-31) or RFC 3339 time
+    --to [date or time]: Only show files uploaded up to and including this date or time
+    --type [MIME type]: Only show files of this type, e.g. image/png or image/*
+    --limit [count]: Files per page (default 100)
+    --cursor [cursor]: Start from the page printed by an earlier list
+search [query]: Search your files by name, tags and description
+    --tag [tag]: Only show files with this tag
+    --limit [count]: Show at most this many files (default 50)
+edit [file ID]: Change a file's tags, description or who can download it
+    --tags [tags]: Replace the file's tags, using "" to remove them all
+    --description [text]: Replace the file's description
+    --private: Only allow downloads with your API key or a link from "share"
+    --public: Allow anyone with the link to download the file
+rename [file ID] [name]: Rename a file, keeping its link
+replace [file ID] [file path]: Replace a file's contents with another file, keeping its link and the old contents as a version
+versions [file ID]: List a file's versions and where to download them
+restore [file ID] [version]: Make an old version of a file current again
+usage: Show how much storage you're using and your quotas
+share [file ID]: Print a temporary download link, which works even for private files
+    --ttl [duration]: How long the link works for (default 1h, at most 30d)
+collection create [name]: Create a collection and print its public link
+collection add [collection ID] [file IDs...]: Add files to a collection
+collection list [collection ID]: List your collections, or the files in one
+collection rm [collection ID] [file ID]: Remove a file from a collection, or delete the collection if no file ID is given
+key rotate: Replace the API key you enter with a new one
+token create [name] --scopes [scopes]: Create an API token, e.g. "token create ci --scopes upload"
+    --expires [duration]: Make the token stop working after a duration (e.g. 90d)
+token list: List your API tokens
+token revoke [token ID]: Revoke one of your API tokens
+user add [username] [permissions]: Create a user and print its API key (admin only)
+user list: List all users (admin only)
+user set-perms [username] [permissions]: Change a user's permissions (admin only)
+user set-quota [username]: Limit a user's storage, using none for no limit (admin only)
+    --size [size]: The total size of their files, e.g. 500MB or 10GB
+    --files [count]: The number of files they can have
+    --max-upload [size]: The largest file they can upload, using none for the server's default
+user disable [username]: Disable all of a user's API tokens (admin only)
+user enable [username]: Re-enable a disabled user (admin only)
+user remove [username]: Delete a user who has no files left, along with their tokens and collections (admin only)
+audit: List recorded changes and failed logins, newest first (admin only)
+    --actor [username]: Only show events by this user
+    --action [action]: Only show this action, e.g. file.delete, or a group of them, e.g. file.*
+    --target [ID]: Only show events affecting this file, collection, token or user
+    --result [success or denied]: Only show events with this result
+    --from [date or time]: Only show events since this date (e.g. 2024-01-31) or RFC 3339 time
+    --to [date or time]: Only show events up to and including this date or time
+    --limit [count]: Events per page (default 100)
+    --cursor [cursor]: Start from the page printed by an earlier audit
+
+Permissions: none, self (read/write own files), all (read/write all files), admin
+Scopes: upload (new files only), list, delete, modify (rename, replace and restore files), tokens (manage your tokens), admin
     `+"\n", version)
 }
 
-func uploadCmd() {
+func deleteCmd() {
     if len(args) < 2 {
-        fmt.Println("The file path is required")
+        fmt.Println("The file ID is required")
         return
     }
 
-    filePath := args[1]
+    fileId := args[1]
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
 
-    if _, err := os.Stat(filePath); os.IsNotExist(err) {
-        fmt.Println("Invalid file path - the file doesn't exist")
+    endpoint, err := url.JoinPath(apiUrl, "/"+fileId)
+    if err != nil {
+        fmt.Println("Error constructing URL")
         return
     }
 
-    file, err := os.Open(filePath)
+    req, err := http.NewRequest("DELETE", endpoint, nil)
     if err != nil {
-        fmt.Println("Error opening file")
+        fmt.Println("Error creating request")
         return
     }
-    defer func(file *os.File) {
-        if err = file.Close(); err != nil {
-            fmt.Println("Error closing file")
+    req.Header.Add("Authorization", "Bearer "+apiKey)
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
         }
-    }(file)
+    }(res)
 
-    fmt.Print("Enter your API key: ")
-    apiKey, err := term.ReadPassword(int(os.Stdin.Fd()))
+    if res.StatusCode == http.StatusOK {
+        fmt.Println("File deleted successfully")
+    } else if res.StatusCode == http.StatusNotFound {
+        fmt.Println("File not found")
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println("Error deleting file")
+    }
+}
+
+func shareCmd() {
+    if len(args) < 2 {
+        fmt.Println("The file ID is required")
+        return
+    }
+
+    fileId := args[1]
+
+    body := map[string]any{}
+    if ttl, ok := flags["ttl"]; ok {
+        body["ttl"] = ttl
+    }
+
+    apiKey, err := readApiKey()
     if err != nil {
         fmt.Println("Error reading input")
         return
     }
-    fmt.Println("[ENTERED]")
-
-    pr, pw := io.Pipe()
-    writer := multipart.NewWriter(pw)
 
-    go func() {
-        defer func(pw *io.PipeWriter) {
-            if err = pw.Close(); err != nil {
-                fmt.Println("Error closing pipe writer")
-            }
-        }(pw)
-        defer func(writer *multipart.Writer) {
-            if err = writer.Close(); err != nil {
-                fmt.Println("Error closing multipart writer")
-            }
-        }(writer)
+    req, err := newJSONRequest("POST", "/"+fileId+"/share", apiKey, body)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
 
-        part, err := writer.CreateFormFile("file", filepath.Base(filePath))
-        if err != nil {
-            if err = pw.CloseWithError(err); err != nil {
-                fmt.Println("Error closing pipe writer")
-            }
-            fmt.Println("Error creating form file")
-            return
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
         }
+    }(res)
 
-        if _, err := io.Copy(part, file); err != nil {
-            if err = pw.CloseWithError(err); err != nil {
-                fmt.Println("Error closing pipe writer")
-            }
-            fmt.Println("Error copying file")
+    if res.StatusCode == http.StatusCreated {
+        var resBody ShareResponseBody
+        if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+            fmt.Println("Error parsing response body")
             return
         }
-    }()
+        fmt.Printf("%s%s\n", strings.TrimSuffix(apiUrl, "/"), resBody.Path)
+        fmt.Printf("This link works until %s\n", resBody.ExpiresAt)
+    } else if res.StatusCode == http.StatusNotFound {
+        fmt.Println("File not found")
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error creating link"))
+    }
+}
 
-    endpoint, err := url.JoinPath(apiUrl, "/upload")
+func usageCmd() {
+    apiKey, err := readApiKey()
     if err != nil {
-        fmt.Println("Error constructing URL")
+        fmt.Println("Error reading input")
         return
     }
 
-    req, err := http.NewRequest("POST", endpoint, pr)
+    req, err := newJSONRequest("GET", "/usage", apiKey, nil)
     if err != nil {
         fmt.Println("Error creating request")
         return
     }
-    req.Header.Add("Authorization", "Bearer "+string(apiKey))
-    req.Header.Add("Content-Type", writer.FormDataContentType())
 
     res, err := client.Do(req)
     if err != nil {
@@ -150,21 +454,155 @@ func uploadCmd() {
         }
     }(res)
 
-    if res.StatusCode == http.StatusCreated {
-        var resBody UploadResponseBody
+    if res.StatusCode == http.StatusOK {
+        var resBody UsageResponseBody
         if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
             fmt.Println("Error parsing response body")
             return
         }
-        fmt.Printf("File uploaded successfully to %s/%s\n", apiUrl, resBody.Id)
+        usage := resBody.Usage
+
+        storage := formatSize(usage.Bytes)
+        if usage.QuotaBytes != nil {
+            storage += fmt.Sprintf(" of %s (%d%%)", formatSize(*usage.QuotaBytes), usage.Bytes*100/max(*usage.QuotaBytes, 1))
+        }
+        files := fmt.Sprint(usage.Files)
+        if usage.QuotaFiles != nil {
+            files += fmt.Sprintf(" of %d", *usage.QuotaFiles)
+        }
+
+        fmt.Printf("Storage: %s\n", storage)
+        if usage.VersionBytes > 0 {
+            fmt.Printf("Old versions: %s (included in storage)\n", formatSize(usage.VersionBytes))
+        }
+        fmt.Printf("Files: %s\n", files)
     } else if res.StatusCode == http.StatusUnauthorized {
         fmt.Println("Invalid API key or insufficient permissions")
     } else {
-        fmt.Println("Error uploading file")
+        fmt.Println(responseMessage(res, "Error fetching usage"))
     }
 }
 
-func deleteCmd() {
+// listOptions maps the list flags to the query parameters they set
+var listOptions = []string{"sort", "order", "creator", "from", "to", "type", "limit", "cursor"}
+
+func listCmd() {
+    query := url.Values{}
+    for _, option := range listOptions {
+        if value := flags[option]; value != "" {
+            query.Set(option, value)
+        }
+    }
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    stdin := bufio.NewReader(os.Stdin)
+    interactive := term.IsTerminal(int(os.Stdin.Fd()))
+
+    for {
+        resBody, ok := fetchFilePage(apiKey, query)
+        if !ok {
+            return
+        }
+
+        if len(resBody.Files) == 0 {
+            fmt.Println("No files found")
+            return
+        }
+
+        rows := [][]string{{"Name", "Size", "Creator", "Uploaded at", "Expires", "Downloads", "Access", "URL"}}
+        for _, file := range resBody.Files {
+            fileUrl, err := url.JoinPath(apiUrl, "/"+file.Id)
+            if err != nil {
+                fmt.Println("Error constructing URL")
+            }
+
+            expires := "never"
+            if file.ExpiresAt != nil {
+                expires = *file.ExpiresAt
+            }
+
+            downloads := fmt.Sprint(file.DownloadCount)
+            if file.MaxDownloads != nil {
+                downloads += fmt.Sprintf("/%d", *file.MaxDownloads)
+            }
+
+            access := "public"
+            if file.Private {
+                access = "private"
+            }
+            if file.HasPassword {
+                access += "+password"
+            }
+
+            rows = append(rows, []string{
+                file.Name, formatSize(file.Size), file.Creator, file.UploadedAt, expires, downloads, access, fileUrl,
+            })
+        }
+
+        fmt.Println()
+        printTable(rows)
+        fmt.Println()
+
+        if resBody.NextCursor == nil {
+            return
+        }
+
+        // Further pages are only fetched when asked for, or left to --cursor when not run interactively
+        if !interactive {
+            fmt.Printf("There are more files - use --cursor %s to see the next page\n", *resBody.NextCursor)
+            return
+        }
+        fmt.Print("There are more files - press Enter to see the next page or q to stop: ")
+        answer, err := stdin.ReadString('\n')
+        if err != nil || strings.TrimSpace(strings.ToLower(answer)) == "q" {
+            return
+        }
+        query.Set("cursor", *resBody.NextCursor)
+    }
+}
+
+// fetchFilePage fetches one page of /list, printing why if it couldn't
+func fetchFilePage(apiKey string, query url.Values) (ListResponseBody, bool) {
+    var resBody ListResponseBody
+
+    req, err := newJSONRequest("GET", "/list", apiKey, nil)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return resBody, false
+    }
+    req.URL.RawQuery = query.Encode()
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return resBody, false
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusOK {
+        if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+            fmt.Println("Error parsing response body")
+            return resBody, false
+        }
+        return resBody, true
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error fetching files"))
+    }
+    return resBody, false
+}
+
+func infoCmd() {
     if len(args) < 2 {
         fmt.Println("The file ID is required")
         return
@@ -172,26 +610,134 @@ func deleteCmd() {
 
     fileId := args[1]
 
-    fmt.Print("Enter your API key: ")
-    apiKey, err := term.ReadPassword(int(os.Stdin.Fd()))
+    // Owners see more details, but public files can be looked up without a key
+    fmt.Println("Leave the API key empty to look up a public file")
+    apiKey, err := readApiKey()
     if err != nil {
         fmt.Println("Error reading input")
         return
     }
-    fmt.Println("[ENTERED]")
 
-    endpoint, err := url.JoinPath(apiUrl, "/"+fileId)
+    req, err := newJSONRequest("GET", "/"+fileId+"/info", apiKey, nil)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+    if apiKey == "" {
+        req.Header.Del("Authorization")
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode != http.StatusOK {
+        fmt.Println(responseMessage(res, "Error fetching file info"))
+        return
+    }
+
+    var resBody FileInfoResponseBody
+    if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+        fmt.Println("Error parsing response body")
+        return
+    }
+    file := resBody.File
+
+    fileUrl, err := url.JoinPath(apiUrl, "/"+file.Id)
     if err != nil {
         fmt.Println("Error constructing URL")
+    }
+
+    expires := "never"
+    if file.ExpiresAt != nil {
+        expires = *file.ExpiresAt
+    }
+
+    rows := [][]string{
+        {"Name:", file.Name},
+        {"URL:", fileUrl},
+        {"Size:", fmt.Sprintf("%s (%d bytes)", formatSize(file.Size), file.Size)},
+        {"Type:", file.MimeType},
+    }
+    // Download-limited files only show their checksum and download count to their owner
+    if file.Checksum != nil {
+        rows = append(rows, []string{"Checksum:", *file.Checksum})
+    }
+    rows = append(rows,
+        []string{"Uploaded by:", file.Creator},
+        []string{"Uploaded at:", file.UploadedAt},
+        []string{"Version:", fmt.Sprint(file.Version)},
+        []string{"Expires:", expires},
+    )
+
+    downloads := "hidden"
+    if file.DownloadCount != nil {
+        downloads = fmt.Sprint(*file.DownloadCount)
+    }
+
+    if file.Owner {
+        if file.MaxDownloads != nil {
+            downloads += fmt.Sprintf(" of %d", *file.MaxDownloads)
+        }
+
+        access := "public"
+        if file.Private {
+            access = "private"
+        }
+        if file.HasPassword {
+            access += ", password protected"
+        }
+
+        rows = append(rows,
+            []string{"Downloads:", downloads},
+            []string{"Access:", access},
+            []string{"Tags:", strings.Join(file.Tags, ", ")},
+            []string{"Description:", file.Description},
+            []string{"Collections:", strings.Join(file.Collections, ", ")},
+        )
+    } else {
+        rows = append(rows, []string{"Downloads:", downloads})
+    }
+
+    fmt.Println()
+    printTable(rows)
+    fmt.Println()
+}
+
+func searchCmd() {
+    if len(args) < 2 && flags["tag"] == "" {
+        fmt.Println("A search query or --tag is required")
         return
     }
 
-    req, err := http.NewRequest("DELETE", endpoint, nil)
+    query := url.Values{}
+    query.Set("q", strings.Join(args[1:], " "))
+    if tag := flags["tag"]; tag != "" {
+        query.Set("tag", tag)
+    }
+    if limit := flags["limit"]; limit != "" {
+        query.Set("limit", limit)
+    }
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("GET", "/search", apiKey, nil)
     if err != nil {
         fmt.Println("Error creating request")
         return
     }
-    req.Header.Add("Authorization", "Bearer "+string(apiKey))
+    req.URL.RawQuery = query.Encode()
 
     res, err := client.Do(req)
     if err != nil {
@@ -205,37 +751,57 @@ func deleteCmd() {
     }(res)
 
     if res.StatusCode == http.StatusOK {
-        fmt.Println("File deleted successfully")
-    } else if res.StatusCode == http.StatusNotFound {
-        fmt.Println("File not found")
+        var resBody ListResponseBody
+        if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+            fmt.Println("Error parsing response body")
+            return
+        }
+
+        if len(resBody.Files) == 0 {
+            fmt.Println("No matching files found")
+            return
+        }
+
+        rows := [][]string{{"Name", "Size", "Tags", "Creator", "Uploaded at", "URL"}}
+        for _, file := range resBody.Files {
+            fileUrl, err := url.JoinPath(apiUrl, "/"+file.Id)
+            if err != nil {
+                fmt.Println("Error constructing URL")
+            }
+            rows = append(rows, []string{
+                file.Name, formatSize(file.Size), strings.Join(file.Tags, ","), file.Creator, file.UploadedAt, fileUrl,
+            })
+        }
+
+        fmt.Println()
+        printTable(rows)
+        fmt.Println()
     } else if res.StatusCode == http.StatusUnauthorized {
         fmt.Println("Invalid API key or insufficient permissions")
     } else {
-        fmt.Println("Error deleting file")
+        fmt.Println(responseMessage(res, "Error searching files"))
     }
 }
 
-func listCmd() {
-    fmt.Print("Enter your API key: ")
-    apiKey, err := term.ReadPassword(int(os.Stdin.Fd()))
-    if err != nil {
-        fmt.Println("Error reading input")
+func renameCmd() {
+    if len(args) < 3 {
+        fmt.Println("The file ID and new name are required")
         return
     }
-    fmt.Println("[ENTERED]")
 
-    endpoint, err := url.JoinPath(apiUrl, "/list")
+    fileId, name := args[1], strings.Join(args[2:], " ")
+
+    apiKey, err := readApiKey()
     if err != nil {
-        fmt.Println("Error constructing URL")
+        fmt.Println("Error reading input")
         return
     }
 
-    req, err := http.NewRequest("GET", endpoint, nil)
+    req, err := newJSONRequest("PATCH", "/"+fileId, apiKey, map[string]any{"name": name})
     if err != nil {
         fmt.Println("Error creating request")
         return
     }
-    req.Header.Add("Authorization", "Bearer "+string(apiKey))
 
     res, err := client.Do(req)
     if err != nil {
@@ -249,74 +815,204 @@ func listCmd() {
     }(res)
 
     if res.StatusCode == http.StatusOK {
-        var resBody ListResponseBody
+        var resBody UpdateFileResponseBody
         if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
             fmt.Println("Error parsing response body")
             return
         }
+        fmt.Printf("File renamed to %s\n", resBody.File.Name)
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error renaming file"))
+    }
+}
 
-        if resBody.Files == nil {
-            fmt.Println("No files found")
-            return
+func versionsCmd() {
+    if len(args) < 2 {
+        fmt.Println("The file ID is required")
+        return
+    }
+
+    fileId := args[1]
+
+    fmt.Println("Leave the API key empty to look up a public file")
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("GET", "/"+fileId+"/versions", apiKey, nil)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+    if apiKey == "" {
+        req.Header.Del("Authorization")
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
         }
+    }(res)
 
-        nameLen := len("Name")
-        urlLen := len("URL")
-        creatorLen := len("Creator")
-        uploadedLen := len("Uploaded at")
-        for _, file := range resBody.Files {
-            length := len(file.Name)
-            if length > nameLen {
-                nameLen = length
-            }
+    if res.StatusCode != http.StatusOK {
+        fmt.Println(responseMessage(res, "Error fetching file versions"))
+        return
+    }
 
-            fileUrl, err := url.JoinPath(apiUrl, "/"+file.Id)
-            if err != nil {
-                fmt.Println("Error constructing URL")
-            }
-            length = len(fileUrl)
-            if length > urlLen {
-                urlLen = length
-            }
+    var resBody VersionsResponseBody
+    if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+        fmt.Println("Error parsing response body")
+        return
+    }
 
-            length = len(file.Creator)
-            if length > creatorLen {
-                creatorLen = length
-            }
+    rows := [][]string{{"Version", "Size", "Type", "Created at", "Replaced at", "URL"}}
+    for _, v := range resBody.Versions {
+        fileUrl, err := url.JoinPath(apiUrl, "/"+fileId)
+        if err != nil {
+            fmt.Println("Error constructing URL")
+        }
 
-            length = len(file.UploadedAt)
-            if length > uploadedLen {
-                uploadedLen = length
-            }
+        number, replacedAt := fmt.Sprint(v.Version), ""
+        if v.Current {
+            number += " (current)"
+        } else {
+            fileUrl += fmt.Sprintf("?v=%d", v.Version)
         }
+        if v.ReplacedAt != nil {
+            replacedAt = *v.ReplacedAt
+        }
+        rows = append(rows, []string{number, formatSize(v.Size), v.MimeType, v.CreatedAt, replacedAt, fileUrl})
+    }
+
+    fmt.Println()
+    printTable(rows)
+    fmt.Println()
+}
+
+func restoreCmd() {
+    if len(args) < 3 {
+        fmt.Println("The file ID and version are required")
+        return
+    }
+
+    fileId, fileVersion := args[1], args[2]
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("POST", "/"+fileId+"/versions/"+fileVersion+"/restore", apiKey, nil)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
 
-        extendStr := func(s string, targetLength int) string {
-            paddingLength := targetLength - len(s)
-            padding := strings.Repeat(" ", paddingLength)
-            return s + padding
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
         }
+    }(res)
 
-        fmt.Printf(
-            "\n%s %s %s %s\n", extendStr("Name", nameLen), extendStr("Creator", creatorLen),
-            extendStr("Uploaded at", uploadedLen), extendStr("URL", urlLen),
-        )
+    if res.StatusCode == http.StatusOK {
+        var resBody UpdateFileResponseBody
+        if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+            fmt.Println("Error parsing response body")
+            return
+        }
+        fmt.Printf("Version %s restored as version %d - it's still at %s/%s\n", fileVersion, resBody.File.Version, apiUrl, fileId)
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error restoring version"))
+    }
+}
 
-        for _, file := range resBody.Files {
-            fileUrl, err := url.JoinPath(apiUrl, "/"+file.Id)
-            if err != nil {
-                fmt.Println("Error constructing URL")
-            }
-            fmt.Printf(
-                "%s %s %s %s\n", extendStr(file.Name, nameLen), extendStr(file.Creator, creatorLen),
-                extendStr(file.UploadedAt, uploadedLen), extendStr(fileUrl, urlLen),
-            )
+func editCmd() {
+    tags, hasTags := flags["tags"]
+    description, hasDescription := flags["description"]
+    _, private := flags["private"]
+    _, public := flags["public"]
+    if len(args) < 2 || (!hasTags && !hasDescription && !private && !public) {
+        fmt.Println("The file ID and --tags, --description, --private or --public are required")
+        return
+    }
+    if private && public {
+        fmt.Println("Only one of --private and --public can be used")
+        return
+    }
+
+    body := map[string]any{}
+    if hasTags {
+        // An empty --tags removes all of the file's tags
+        body["tags"] = []string{}
+        if tags != "" {
+            body["tags"] = strings.Split(tags, ",")
         }
+    }
+    if hasDescription {
+        body["description"] = description
+    }
+    if private || public {
+        body["private"] = private
+    }
 
-        fmt.Println()
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("PATCH", "/"+args[1], apiKey, body)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusOK {
+        var resBody UpdateFileResponseBody
+        if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+            fmt.Println("Error parsing response body")
+            return
+        }
+        access := "public"
+        if resBody.File.Private {
+            access = "private"
+        }
+        fmt.Println("File updated successfully")
+        fmt.Printf("Tags: %s\n", strings.Join(resBody.File.Tags, ", "))
+        fmt.Printf("Description: %s\n", resBody.File.Description)
+        fmt.Printf("Access: %s\n", access)
     } else if res.StatusCode == http.StatusUnauthorized {
         fmt.Println("Invalid API key or insufficient permissions")
     } else {
-        fmt.Println("Error fetching files")
+        fmt.Println(responseMessage(res, "Error updating file"))
     }
 }
 
@@ -331,6 +1027,34 @@ func main() {
         deleteCmd()
     } else if args[0] == "list" {
         listCmd()
+    } else if args[0] == "info" {
+        infoCmd()
+    } else if args[0] == "search" {
+        searchCmd()
+    } else if args[0] == "edit" {
+        editCmd()
+    } else if args[0] == "rename" {
+        renameCmd()
+    } else if args[0] == "replace" {
+        replaceCmd()
+    } else if args[0] == "versions" {
+        versionsCmd()
+    } else if args[0] == "restore" {
+        restoreCmd()
+    } else if args[0] == "usage" {
+        usageCmd()
+    } else if args[0] == "share" {
+        shareCmd()
+    } else if args[0] == "collection" {
+        collectionCmd()
+    } else if args[0] == "token" {
+        tokenCmd()
+    } else if args[0] == "key" {
+        keyCmd()
+    } else if args[0] == "user" {
+        userCmd()
+    } else if args[0] == "audit" {
+        auditCmd()
     } else {
         fmt.Println("Unknown command (maybe try `help` instead)")
     }
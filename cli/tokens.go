@@ -0,0 +1,277 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+)
+
+type Token struct {
+    Id         int64    `json:"id"`
+    Name       string   `json:"name"`
+    Scopes     []string `json:"scopes"`
+    KeyPrefix  string   `json:"keyPrefix"`
+    CreatedAt  string   `json:"createdAt"`
+    ExpiresAt  *string  `json:"expiresAt"`
+    LastUsedAt *string  `json:"lastUsedAt"`
+    Current    bool     `json:"current"`
+}
+
+type CreateTokenResponseBody struct {
+    Token  Token  `json:"token"`
+    ApiKey string `json:"apiKey"`
+}
+
+type ListTokensResponseBody struct {
+    Tokens []Token `json:"tokens"`
+}
+
+type RotateKeyResponseBody struct {
+    ApiKey string `json:"apiKey"`
+}
+
+var scopeNames = []string{"upload", "list", "delete", "tokens", "admin", "modify"}
+
+func parseScopes(s string) ([]string, bool) {
+    var scopes []string
+
+    for _, scope := range strings.Split(s, ",") {
+        scope = strings.ToLower(strings.TrimSpace(scope))
+
+        valid := false
+        for _, name := range scopeNames {
+            if scope == name {
+                valid = true
+            }
+        }
+        if !valid {
+            return nil, false
+        }
+
+        scopes = append(scopes, scope)
+    }
+
+    return scopes, true
+}
+
+func tokenCmd() {
+    if len(args) < 2 {
+        fmt.Println("A token subcommand is required (create, list, revoke)")
+        return
+    }
+
+    if args[1] == "create" {
+        tokenCreateCmd()
+    } else if args[1] == "list" {
+        tokenListCmd()
+    } else if args[1] == "revoke" {
+        tokenRevokeCmd()
+    } else {
+        fmt.Println("Unknown token subcommand (maybe try `help` instead)")
+    }
+}
+
+func tokenCreateCmd() {
+    if len(args) < 3 || flags["scopes"] == "" {
+        fmt.Println("The token name and --scopes are required")
+        return
+    }
+
+    name := args[2]
+    scopes, ok := parseScopes(flags["scopes"])
+    if !ok {
+        fmt.Printf("Invalid scopes - use a comma-separated list of %s\n", strings.Join(scopeNames, ", "))
+        return
+    }
+
+    body := map[string]any{
+        "name":   name,
+        "scopes": scopes,
+    }
+    if expires, ok := flags["expires"]; ok {
+        body["expiresIn"] = expires
+    }
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("POST", "/tokens", apiKey, body)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusCreated {
+        var resBody CreateTokenResponseBody
+        if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+            fmt.Println("Error parsing response body")
+            return
+        }
+        fmt.Printf("Token %d (%s) created with scopes %s\n", resBody.Token.Id, resBody.Token.Name, strings.Join(resBody.Token.Scopes, ", "))
+        fmt.Printf("API key: %s\n", resBody.ApiKey)
+        fmt.Println("Store this key somewhere safe - it won't be shown again")
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error creating token"))
+    }
+}
+
+func tokenListCmd() {
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("GET", "/tokens", apiKey, nil)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusOK {
+        var resBody ListTokensResponseBody
+        if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+            fmt.Println("Error parsing response body")
+            return
+        }
+
+        optional := func(s *string) string {
+            if s == nil {
+                return "never"
+            }
+            return *s
+        }
+
+        rows := [][]string{{"ID", "Name", "Key ID", "Scopes", "Expires", "Last used"}}
+        for _, token := range resBody.Tokens {
+            id := fmt.Sprint(token.Id)
+            if token.Current {
+                id += "*"
+            }
+            rows = append(rows, []string{
+                id, token.Name, token.KeyPrefix, strings.Join(token.Scopes, ","),
+                optional(token.ExpiresAt), optional(token.LastUsedAt),
+            })
+        }
+
+        fmt.Println()
+        printTable(rows)
+        fmt.Println("\n* the token used for this request")
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error fetching tokens"))
+    }
+}
+
+func tokenRevokeCmd() {
+    if len(args) < 3 {
+        fmt.Println("The token ID is required")
+        return
+    }
+
+    tokenId := args[2]
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("DELETE", "/tokens/"+tokenId, apiKey, nil)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusOK {
+        fmt.Println("Token revoked successfully")
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error revoking token"))
+    }
+}
+
+func keyCmd() {
+    if len(args) < 2 || args[1] != "rotate" {
+        fmt.Println("Unknown key subcommand (maybe try `help` instead)")
+        return
+    }
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("POST", "/keys/rotate", apiKey, nil)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusOK {
+        var resBody RotateKeyResponseBody
+        if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+            fmt.Println("Error parsing response body")
+            return
+        }
+        fmt.Printf("New API key: %s\n", resBody.ApiKey)
+        fmt.Println("Your old key no longer works - store this one somewhere safe")
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key")
+    } else {
+        fmt.Println(responseMessage(res, "Error rotating API key"))
+    }
+}
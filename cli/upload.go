@@ -0,0 +1,485 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "golang.org/x/term"
+)
+
+// Uploads use the tus resumable upload protocol, with the URL of each unfinished upload saved locally
+// so running the same upload command again picks up where the last attempt stopped
+
+const uploadChunkSize = 8 * 1024 * 1024
+const uploadMaxRetries = 5
+
+type uploadProgress struct {
+    offset int64
+    fileId string
+}
+
+func uploadStatePath() (string, error) {
+    dir, err := os.UserCacheDir()
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, "eulm-files", "uploads.json"), nil
+}
+
+func loadUploadState() map[string]string {
+    state := map[string]string{}
+
+    path, err := uploadStatePath()
+    if err != nil {
+        return state
+    }
+
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return state
+    }
+    if err = json.Unmarshal(data, &state); err != nil {
+        return map[string]string{}
+    }
+
+    return state
+}
+
+func saveUploadState(state map[string]string) error {
+    path, err := uploadStatePath()
+    if err != nil {
+        return err
+    }
+
+    if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return err
+    }
+
+    data, err := json.Marshal(state)
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(path, data, 0600)
+}
+
+// uploadStateKey identifies a file by its path, size and modification time along with the upload's options, so a
+// file that has changed since an interrupted upload, or is uploaded with different options, is uploaded from scratch.
+// The options are hashed to keep the password out of the saved state
+func uploadStateKey(filePath string, info os.FileInfo, metadata map[string]string) string {
+    absPath, err := filepath.Abs(filePath)
+    if err != nil {
+        absPath = filePath
+    }
+    options := sha256.Sum256([]byte(encodeTusMetadata(metadata)))
+    return fmt.Sprintf("%s|%s|%d|%d|%s", apiUrl, absPath, info.Size(), info.ModTime().UnixNano(), hex.EncodeToString(options[:]))
+}
+
+func newTusRequest(method string, location string, apiKey string, body io.Reader) (*http.Request, error) {
+    endpoint := location
+    if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+        var err error
+        if endpoint, err = url.JoinPath(apiUrl, location); err != nil {
+            return nil, err
+        }
+    }
+
+    req, err := http.NewRequest(method, endpoint, body)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Add("Authorization", "Bearer "+apiKey)
+    req.Header.Add("Tus-Resumable", "1.0.0")
+
+    return req, nil
+}
+
+// tusHead fetches the current offset of an upload, returning a nil progress if the upload no longer exists
+func tusHead(location string, apiKey string) (*uploadProgress, error) {
+    req, err := newTusRequest("HEAD", location, apiKey, nil)
+    if err != nil {
+        return nil, err
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if err = res.Body.Close(); err != nil {
+        return nil, err
+    }
+
+    if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone {
+        return nil, nil
+    }
+    if res.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("unexpected status %s", res.Status)
+    }
+
+    offset, err := strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64)
+    if err != nil {
+        return nil, err
+    }
+
+    return &uploadProgress{offset: offset, fileId: res.Header.Get("Eulm-File-Id")}, nil
+}
+
+// encodeTusMetadata builds an Upload-Metadata header, skipping empty values
+func encodeTusMetadata(metadata map[string]string) string {
+    keys := make([]string, 0, len(metadata))
+    for key, value := range metadata {
+        if value != "" {
+            keys = append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+
+    pairs := make([]string, len(keys))
+    for i, key := range keys {
+        pairs[i] = key + " " + base64.StdEncoding.EncodeToString([]byte(metadata[key]))
+    }
+    return strings.Join(pairs, ",")
+}
+
+func tusCreate(metadata map[string]string, size int64, apiKey string) (string, error) {
+    req, err := newTusRequest("POST", "/tus", apiKey, nil)
+    if err != nil {
+        return "", err
+    }
+    req.Header.Add("Upload-Length", strconv.FormatInt(size, 10))
+    req.Header.Add("Upload-Metadata", encodeTusMetadata(metadata))
+
+    res, err := client.Do(req)
+    if err != nil {
+        return "", errors.New("Error sending request")
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusUnauthorized {
+        return "", errors.New("Invalid API key or insufficient permissions")
+    } else if res.StatusCode != http.StatusCreated {
+        return "", errors.New(responseMessage(res, "Error uploading file"))
+    }
+
+    return res.Header.Get("Location"), nil
+}
+
+// tusPatch sends the next chunk of the file from the given offset, returning whether a failure is worth retrying
+func tusPatch(location string, apiKey string, file *os.File, offset int64, size int64) (*uploadProgress, bool, error) {
+    if _, err := file.Seek(offset, io.SeekStart); err != nil {
+        return nil, false, err
+    }
+
+    length := min(size-offset, uploadChunkSize)
+    req, err := newTusRequest("PATCH", location, apiKey, io.LimitReader(file, length))
+    if err != nil {
+        return nil, false, err
+    }
+    req.ContentLength = length
+    req.Header.Add("Content-Type", "application/offset+octet-stream")
+    req.Header.Add("Upload-Offset", strconv.FormatInt(offset, 10))
+
+    res, err := transferClient.Do(req)
+    if err != nil {
+        return nil, true, err
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusUnauthorized {
+        return nil, false, errors.New("Invalid API key or insufficient permissions")
+    } else if res.StatusCode == http.StatusConflict || res.StatusCode == http.StatusTooManyRequests ||
+        (res.StatusCode >= 500 && res.StatusCode != http.StatusInsufficientStorage) {
+        return nil, true, fmt.Errorf("unexpected status %s", res.Status)
+    } else if res.StatusCode != http.StatusNoContent {
+        return nil, false, errors.New(responseMessage(res, "Error uploading file"))
+    }
+
+    newOffset, err := strconv.ParseInt(res.Header.Get("Upload-Offset"), 10, 64)
+    if err != nil {
+        return nil, true, err
+    }
+
+    return &uploadProgress{offset: newOffset, fileId: res.Header.Get("Eulm-File-Id")}, false, nil
+}
+
+type LimitsResponseBody struct {
+    MaxUploadSize int64 `json:"maxUploadSize"`
+}
+
+func fetchMaxUploadSize(apiKey string) (int64, error) {
+    req, err := newJSONRequest("GET", "/limits", apiKey, nil)
+    if err != nil {
+        return 0, err
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        return 0, err
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode != http.StatusOK {
+        return 0, fmt.Errorf("unexpected status %s", res.Status)
+    }
+
+    var resBody LimitsResponseBody
+    if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+        return 0, err
+    }
+    return resBody.MaxUploadSize, nil
+}
+
+// readFilePassword asks for the password to protect an upload with, twice to catch typos
+func readFilePassword() (string, error) {
+    fmt.Print("Enter a password for the file: ")
+    password, err := term.ReadPassword(int(os.Stdin.Fd()))
+    if err != nil {
+        return "", errors.New("Error reading input")
+    }
+    fmt.Println("[ENTERED]")
+
+    fmt.Print("Enter it again: ")
+    confirmation, err := term.ReadPassword(int(os.Stdin.Fd()))
+    if err != nil {
+        return "", errors.New("Error reading input")
+    }
+    fmt.Println("[ENTERED]")
+
+    if len(password) == 0 {
+        return "", errors.New("The password can't be empty")
+    }
+    if string(password) != string(confirmation) {
+        return "", errors.New("The passwords don't match")
+    }
+    return string(password), nil
+}
+
+func uploadCmd() {
+    if len(args) < 2 {
+        fmt.Println("The file path is required")
+        return
+    }
+
+    filePath := args[1]
+    metadata := map[string]string{"filename": filepath.Base(filePath)}
+
+    if expires := flags["expires"]; expires != "" {
+        if _, err := time.Parse(time.RFC3339, expires); err == nil {
+            metadata["expires_at"] = expires
+        } else {
+            metadata["expires_in"] = expires
+        }
+    }
+
+    metadata["max_downloads"] = flags["max-downloads"]
+    metadata["burn_after_reading"] = flags["burn"]
+    metadata["private"] = flags["private"]
+    metadata["collection"] = flags["collection"]
+    metadata["tags"] = flags["tags"]
+    metadata["description"] = flags["description"]
+
+    info, err := os.Stat(filePath)
+    if os.IsNotExist(err) {
+        fmt.Println("Invalid file path - the file doesn't exist")
+        return
+    } else if err != nil {
+        fmt.Println("Error reading file")
+        return
+    }
+
+    file, err := os.Open(filePath)
+    if err != nil {
+        fmt.Println("Error opening file")
+        return
+    }
+    defer func(file *os.File) {
+        if err = file.Close(); err != nil {
+            fmt.Println("Error closing file")
+        }
+    }(file)
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    if flags["password"] == "true" {
+        password, err := readFilePassword()
+        if err != nil {
+            fmt.Println(err.Error())
+            return
+        }
+        metadata["password"] = password
+    }
+
+    size := info.Size()
+    state := loadUploadState()
+    stateKey := uploadStateKey(filePath, info, metadata)
+
+    var progress *uploadProgress
+    location, resuming := state[stateKey]
+    if resuming {
+        if progress, err = tusHead(location, apiKey); err != nil {
+            fmt.Println("Error checking previous upload")
+            return
+        }
+        if progress != nil && progress.fileId == "" {
+            fmt.Printf("Resuming previous upload from %d%%\n", progress.offset*100/max(size, 1))
+        }
+    }
+
+    if progress == nil {
+        // The server checks this too, but asking first avoids sending a file only to have it rejected
+        if maxUploadSize, err := fetchMaxUploadSize(apiKey); err == nil && size > maxUploadSize {
+            fmt.Printf("File is too large - the limit for your API key is %s\n", formatSize(maxUploadSize))
+            return
+        }
+
+        if location, err = tusCreate(metadata, size, apiKey); err != nil {
+            fmt.Println(err.Error())
+            return
+        }
+        progress = &uploadProgress{}
+
+        state[stateKey] = location
+        if err = saveUploadState(state); err != nil {
+            fmt.Println("Warning: couldn't save upload state, so this upload can't be resumed")
+        }
+    }
+
+    retries := 0
+    for progress.fileId == "" {
+        next, retryable, err := tusPatch(location, apiKey, file, progress.offset, size)
+        if err != nil {
+            if !retryable {
+                fmt.Println("\n" + err.Error())
+                return
+            }
+            if retries >= uploadMaxRetries {
+                fmt.Println("\nUpload interrupted - run the same command again to resume it")
+                return
+            }
+            retries++
+            time.Sleep(time.Duration(retries) * time.Second)
+
+            // The server keeps whatever it received before the failure, so carry on from its offset
+            if next, err = tusHead(location, apiKey); err != nil || next == nil {
+                continue
+            }
+        } else {
+            retries = 0
+        }
+
+        progress = next
+        fmt.Printf("\rUploaded %d%% (%d/%d bytes)", progress.offset*100/max(size, 1), progress.offset, size)
+    }
+    fmt.Println()
+
+    delete(state, stateKey)
+    if err = saveUploadState(state); err != nil {
+        fmt.Println("Warning: couldn't clear upload state")
+    }
+
+    fmt.Printf("File uploaded successfully to %s/%s\n", apiUrl, progress.fileId)
+}
+
+func replaceCmd() {
+    if len(args) < 3 {
+        fmt.Println("The file ID and the path of the new file are required")
+        return
+    }
+
+    fileId, filePath := args[1], args[2]
+
+    info, err := os.Stat(filePath)
+    if os.IsNotExist(err) {
+        fmt.Println("Invalid file path - the file doesn't exist")
+        return
+    } else if err != nil {
+        fmt.Println("Error reading file")
+        return
+    }
+
+    file, err := os.Open(filePath)
+    if err != nil {
+        fmt.Println("Error opening file")
+        return
+    }
+    defer func(file *os.File) {
+        if err = file.Close(); err != nil {
+            fmt.Println("Error closing file")
+        }
+    }(file)
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    if maxUploadSize, err := fetchMaxUploadSize(apiKey); err == nil && info.Size() > maxUploadSize {
+        fmt.Printf("File is too large - the limit for your API key is %s\n", formatSize(maxUploadSize))
+        return
+    }
+
+    endpoint, err := url.JoinPath(apiUrl, "/"+fileId+"/content")
+    if err != nil {
+        fmt.Println("Error constructing URL")
+        return
+    }
+
+    // The file is closed by the deferred call above rather than by the client
+    req, err := http.NewRequest("PUT", endpoint, io.NopCloser(file))
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+    req.ContentLength = info.Size()
+    req.Header.Add("Authorization", "Bearer "+apiKey)
+    req.Header.Add("Content-Type", "application/octet-stream")
+
+    fmt.Printf("Uploading %s...\n", formatSize(info.Size()))
+    res, err := transferClient.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusOK {
+        fmt.Printf("File replaced successfully - it's still at %s/%s\n", apiUrl, fileId)
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error replacing file"))
+    }
+}
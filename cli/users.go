@@ -0,0 +1,328 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+)
+
+type User struct {
+    Username      string `json:"username"`
+    Permissions   int    `json:"permissions"`
+    Disabled      bool   `json:"disabled"`
+    QuotaBytes    *int64 `json:"quotaBytes"`
+    QuotaFiles    *int64 `json:"quotaFiles"`
+    MaxUploadSize *int64 `json:"maxUploadSize"`
+}
+
+type CreateUserResponseBody struct {
+    User   User   `json:"user"`
+    ApiKey string `json:"apiKey"`
+}
+
+type ListUsersResponseBody struct {
+    Users []User `json:"users"`
+}
+
+var permissionNames = []string{"none", "self", "all", "admin"}
+
+func parsePermissions(s string) (int, bool) {
+    for i, name := range permissionNames {
+        if strings.EqualFold(s, name) {
+            return i, true
+        }
+    }
+
+    perms, err := strconv.Atoi(s)
+    if err != nil || perms < 0 || perms >= len(permissionNames) {
+        return 0, false
+    }
+    return perms, true
+}
+
+func permissionName(perms int) string {
+    if perms < 0 || perms >= len(permissionNames) {
+        return strconv.Itoa(perms)
+    }
+    return permissionNames[perms]
+}
+
+func userCmd() {
+    if len(args) < 2 {
+        fmt.Println("A user subcommand is required (add, list, set-perms, set-quota, disable, enable, remove)")
+        return
+    }
+
+    if args[1] == "add" {
+        userAddCmd()
+    } else if args[1] == "list" {
+        userListCmd()
+    } else if args[1] == "set-perms" {
+        userUpdateCmd("permissions")
+    } else if args[1] == "set-quota" {
+        userUpdateCmd("quota")
+    } else if args[1] == "disable" {
+        userUpdateCmd("disable")
+    } else if args[1] == "enable" {
+        userUpdateCmd("enable")
+    } else if args[1] == "remove" {
+        userRemoveCmd()
+    } else {
+        fmt.Println("Unknown user subcommand (maybe try `help` instead)")
+    }
+}
+
+func userAddCmd() {
+    if len(args) < 4 {
+        fmt.Println("The username and permissions are required")
+        return
+    }
+
+    username := args[2]
+    perms, ok := parsePermissions(args[3])
+    if !ok {
+        fmt.Println("Invalid permissions - use none, self, all or admin")
+        return
+    }
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("POST", "/admin/users", apiKey, map[string]any{
+        "username":    username,
+        "permissions": perms,
+    })
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusCreated {
+        var resBody CreateUserResponseBody
+        if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+            fmt.Println("Error parsing response body")
+            return
+        }
+        fmt.Printf("User %s created with %s permissions\n", resBody.User.Username, permissionName(resBody.User.Permissions))
+        fmt.Printf("API key: %s\n", resBody.ApiKey)
+        fmt.Println("Store this key somewhere safe - it won't be shown again")
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error creating user"))
+    }
+}
+
+func userListCmd() {
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("GET", "/admin/users", apiKey, nil)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusOK {
+        var resBody ListUsersResponseBody
+        if err = json.NewDecoder(res.Body).Decode(&resBody); err != nil {
+            fmt.Println("Error parsing response body")
+            return
+        }
+
+        rows := [][]string{{"Username", "Permissions", "Status", "Storage quota", "File quota", "Max upload"}}
+        for _, user := range resBody.Users {
+            status := "active"
+            if user.Disabled {
+                status = "disabled"
+            }
+            storageQuota, fileQuota := "unlimited", "unlimited"
+            if user.QuotaBytes != nil {
+                storageQuota = formatSize(*user.QuotaBytes)
+            }
+            if user.QuotaFiles != nil {
+                fileQuota = fmt.Sprint(*user.QuotaFiles)
+            }
+
+            maxUpload := "default"
+            if user.MaxUploadSize != nil {
+                maxUpload = formatSize(*user.MaxUploadSize)
+            }
+
+            rows = append(rows, []string{
+                user.Username, permissionName(user.Permissions), status, storageQuota, fileQuota, maxUpload,
+            })
+        }
+
+        fmt.Println()
+        printTable(rows)
+        fmt.Println()
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error fetching users"))
+    }
+}
+
+func userUpdateCmd(change string) {
+    if len(args) < 3 {
+        fmt.Println("The username is required")
+        return
+    }
+
+    username := args[2]
+    body := map[string]any{}
+
+    if change == "permissions" {
+        if len(args) < 4 {
+            fmt.Println("The permissions are required")
+            return
+        }
+        perms, ok := parsePermissions(args[3])
+        if !ok {
+            fmt.Println("Invalid permissions - use none, self, all or admin")
+            return
+        }
+        body["permissions"] = perms
+    } else if change == "quota" {
+        size, hasSize := flags["size"]
+        files, hasFiles := flags["files"]
+        maxUpload, hasMaxUpload := flags["max-upload"]
+        if !hasSize && !hasFiles && !hasMaxUpload {
+            fmt.Println("At least one of --size, --files and --max-upload is required")
+            return
+        }
+
+        if hasSize {
+            quotaBytes, ok := parseSize(size)
+            if !ok {
+                fmt.Println("Invalid size - use a number of bytes or a size like 500MB or 10GB")
+                return
+            }
+            body["quotaBytes"] = quotaBytes
+        }
+        if hasFiles {
+            if strings.EqualFold(files, "none") {
+                files = "0"
+            }
+            quotaFiles, err := strconv.Atoi(files)
+            if err != nil || quotaFiles < 0 {
+                fmt.Println("Invalid file count")
+                return
+            }
+            body["quotaFiles"] = quotaFiles
+        }
+        if hasMaxUpload {
+            maxUploadSize, ok := parseSize(maxUpload)
+            if !ok {
+                fmt.Println("Invalid max upload size - use a number of bytes or a size like 500MB or 10GB")
+                return
+            }
+            body["maxUploadSize"] = maxUploadSize
+        }
+    } else {
+        body["disabled"] = change == "disable"
+    }
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("PATCH", "/admin/users/"+url.PathEscape(username), apiKey, body)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusOK {
+        fmt.Println("User updated successfully")
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error updating user"))
+    }
+}
+
+func userRemoveCmd() {
+    if len(args) < 3 {
+        fmt.Println("The username is required")
+        return
+    }
+
+    username := args[2]
+
+    apiKey, err := readApiKey()
+    if err != nil {
+        fmt.Println("Error reading input")
+        return
+    }
+
+    req, err := newJSONRequest("DELETE", "/admin/users/"+url.PathEscape(username), apiKey, nil)
+    if err != nil {
+        fmt.Println("Error creating request")
+        return
+    }
+
+    res, err := client.Do(req)
+    if err != nil {
+        fmt.Println("Error sending request")
+        return
+    }
+    defer func(res *http.Response) {
+        if err = res.Body.Close(); err != nil {
+            fmt.Println("Error closing response body")
+        }
+    }(res)
+
+    if res.StatusCode == http.StatusOK {
+        fmt.Println("User deleted successfully")
+    } else if res.StatusCode == http.StatusUnauthorized {
+        fmt.Println("Invalid API key or insufficient permissions")
+    } else {
+        fmt.Println(responseMessage(res, "Error deleting user"))
+    }
+}